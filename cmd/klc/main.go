@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tivizi/kvm-lvm-csi/endpoint"
+	"github.com/tivizi/kvm-lvm-csi/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// version is set at build time.
+var version = "1.0.0"
+
+// Modes select the services the binary serves.
+const (
+	modeController = "controller"
+	modeNode       = "node"
+	modeAll        = "all"
+)
+
+var (
+	mode            = flag.String("mode", modeAll, "services to serve: controller, node or all")
+	csiEndpoint     = flag.String("endpoint", "unix:///tmp/csi.sock", "CSI endpoint")
+	driverName      = flag.String("driver-name", pkg.DefaultDriverName, "name of the driver")
+	nodeId          = flag.String("nodeid", "", "node id, the libvirt domain name of the node")
+	volumeGroup     = flag.String("volume-group", "storages", "LVM volume group volumes are created in")
+	metadataDir     = flag.String("metadata-dir", "data", "directory of the volume metadata")
+	libvirtURI      = flag.String("libvirt-uri", "", "libvirt connection URI, the virsh default if empty")
+	attachMode      = flag.String("attach-mode", "virtio", "disk attachment mode: virtio or scsi")
+	probeInterval   = flag.Duration("probe-interval", time.Minute, "interval of the dependency checks reported by Probe")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "time in-flight RPCs get to finish on SIGTERM or SIGINT")
+	tlsCert         = flag.String("tls-cert", "", "server certificate of a tcp endpoint")
+	tlsKey          = flag.String("tls-key", "", "server key of a tcp endpoint")
+	tlsClientCA     = flag.String("tls-client-ca", "", "CA client certificates of a tcp endpoint must be signed by, enables mutual TLS")
+	insecureTCP     = flag.Bool("allow-insecure-tcp", false, "serve a tcp endpoint without TLS")
+	metricsAddress  = flag.String("metrics-address", "", "address of the Prometheus metrics endpoint, e.g. :9808, disabled if empty")
+	traceExporter   = flag.String("trace-exporter", "", "export OpenTelemetry spans with otlp or to a file, disabled if empty")
+	traceEndpoint   = flag.String("trace-otlp-endpoint", "", "host:port of the OTLP gRPC collector, OTEL_EXPORTER_OTLP_ENDPOINT if empty")
+	traceInsecure   = flag.Bool("trace-otlp-insecure", false, "connect to the OTLP collector without TLS")
+	traceFile       = flag.String("trace-file", "", "file the file exporter appends spans to as JSON")
+	logFormat       = flag.String("log-format", pkg.LogFormatText, "log format: text or json")
+	commandTimeout  = flag.Duration("command-timeout", pkg.DefaultCommandTimeout, "time lvcreate, virsh and other commands get before they are killed")
+	commandTimeouts = flag.String("command-timeouts", "", "timeouts of single commands or operations, e.g. lvcreate=5m,virsh:attach-device=30s")
+	reconcileEvery  = flag.Duration("reconcile-interval", 10*time.Minute, "interval of the reconciliation of attachments with libvirt and LVM in controller mode, only at startup if 0")
+	gcInterval      = flag.Duration("gc-interval", 0, "interval of the garbage collection of orphaned volumes in controller mode, disabled if 0")
+	gcKnownVolumes  = flag.String("gc-known-volumes", "", "volumes in use for the garbage collection and the reconciliation, kubernetes for the PersistentVolumes of the driver or file:<path> for a list of volume ids")
+	gcGracePeriod   = flag.Duration("gc-grace-period", 24*time.Hour, "age orphaned volumes must reach before they are removed")
+	gcDryRun        = flag.Bool("gc-dry-run", false, "only log the orphaned volumes the garbage collection would remove")
+	iotuneFromPVs   = flag.Bool("iotune-annotations", false, "override the StorageClass I/O limits of volumes with annotations of their PersistentVolumes in controller mode")
+)
+
+func main() {
+	flag.Parse()
+	defer glog.Flush()
+	if err := pkg.SetupLogging(*logFormat); err != nil {
+		fatal(err, "Invalid --log-format")
+	}
+
+	controller := *mode == modeController || *mode == modeAll
+	node := *mode == modeNode || *mode == modeAll
+	if !controller && !node {
+		fatal(fmt.Errorf("invalid mode %q", *mode), "Invalid --mode")
+	}
+	if node && *nodeId == "" {
+		fatal(fmt.Errorf("--nodeid is required in %s mode", *mode), "Missing --nodeid")
+	}
+
+	timeouts, err := pkg.ParseCommandTimeouts(*commandTimeouts)
+	if err != nil {
+		fatal(err, "Invalid --command-timeouts")
+	}
+	pkg.SetCommandTimeouts(*commandTimeout, timeouts)
+
+	var overrides pkg.IOTuneOverrides
+	if controller && *iotuneFromPVs {
+		overrides, err = pkg.NewKubernetesIOTuneOverrides(*driverName)
+		if err != nil {
+			fatal(err, "Failed to read I/O limits from annotations")
+		}
+	}
+
+	pkg.SetMetadataDir(*metadataDir)
+	driver, err := pkg.NewDriver(pkg.Config{
+		Name:            *driverName,
+		Version:         version,
+		NodeID:          *nodeId,
+		AttachMode:      *attachMode,
+		VolumeGroup:     *volumeGroup,
+		LibvirtURI:      *libvirtURI,
+		IOTuneOverrides: overrides,
+	})
+	if err != nil {
+		fatal(err, "Failed to initialize driver")
+	}
+
+	var checks []pkg.ProbeCheck
+	if controller {
+		checks = append(checks, driver.ControllerProbeChecks()...)
+	}
+	if node {
+		checks = append(checks, driver.NodeProbeChecks()...)
+	}
+	driver.StartProbing(checks, *probeInterval)
+
+	var metricsServer *http.Server
+	if *metricsAddress != "" {
+		if controller {
+			if err := driver.RegisterControllerMetrics(); err != nil {
+				fatal(err, "Failed to register metrics")
+			}
+		}
+		metricsServer, err = serveMetrics(*metricsAddress)
+		if err != nil {
+			fatal(err, "Failed to serve metrics")
+		}
+	}
+
+	interceptors := []grpc.UnaryServerInterceptor{pkg.MetricsGRPC, pkg.LogGRPC}
+	shutdownTracing := func(context.Context) error { return nil }
+	if *traceExporter != "" {
+		shutdownTracing, err = pkg.SetupTracing(*driverName, version, pkg.TracingConfig{
+			Exporter:     *traceExporter,
+			OTLPEndpoint: *traceEndpoint,
+			OTLPInsecure: *traceInsecure,
+			File:         *traceFile,
+		})
+		if err != nil {
+			fatal(err, "Failed to set up tracing")
+		}
+		interceptors = append([]grpc.UnaryServerInterceptor{pkg.TraceGRPC}, interceptors...)
+	}
+	defer flushTraces(shutdownTracing)
+
+	if controller {
+		var known pkg.KnownVolumes
+		if *gcKnownVolumes != "" || *gcInterval > 0 {
+			known, err = pkg.ParseKnownVolumes(*gcKnownVolumes, *driverName)
+			if err != nil {
+				fatal(err, "Invalid --gc-known-volumes")
+			}
+		}
+		if err := driver.AdoptVolumes(context.Background()); err != nil {
+			pkg.Log.Error(err, "Failed to adopt untagged volumes")
+		}
+		driver.StartReconciling(*reconcileEvery, known)
+		if *gcInterval > 0 {
+			driver.StartGC(pkg.GCConfig{
+				Known:       known,
+				GracePeriod: *gcGracePeriod,
+				DryRun:      *gcDryRun,
+			}, *gcInterval)
+		}
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(interceptors...),
+	}
+	creds, err := serverCredentials()
+	if err != nil {
+		fatal(err, "Failed to configure TLS")
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	if proto, addr, err := endpoint.Parse(*csiEndpoint); err == nil && proto == "unix" && !filepath.IsAbs(addr) {
+		// unix://tmp/csi.sock used to mean /tmp/csi.sock.
+		pkg.Log.Info("Endpoint is a path relative to the working directory, use unix:///<path> for an absolute one",
+			"endpoint", *csiEndpoint, "path", addr)
+	}
+	listener, cleanup, err := endpoint.Listen(*csiEndpoint)
+	if err != nil {
+		fatal(err, "Failed to listen")
+	}
+
+	server := grpc.NewServer(opts...)
+
+	csi.RegisterIdentityServer(server, driver)
+	if controller {
+		csi.RegisterControllerServer(server, driver)
+	}
+	if node {
+		csi.RegisterNodeServer(server, driver)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	served := make(chan error, 1)
+	pkg.Log.Info("Listening for connections", "address", listener.Addr().String())
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		cleanup()
+		flushTraces(shutdownTracing)
+		fatal(err, "Failed to serve")
+	case sig := <-signals:
+		pkg.Log.Info("Stopping", "signal", sig.String())
+		shutdown(server, *shutdownTimeout)
+		stopMetrics(metricsServer, *shutdownTimeout)
+		cleanup()
+	}
+}
+
+// fatal logs the error and exits.
+func fatal(err error, msg string) {
+	pkg.Log.Error(err, msg)
+	glog.Flush()
+	os.Exit(1)
+}
+
+// serverCredentials returns the TLS credentials of a tcp endpoint. Plain TCP
+// exposes the hypervisor to anyone who can reach the port, so it is refused
+// unless explicitly allowed.
+func serverCredentials() (credentials.TransportCredentials, error) {
+	proto, _, err := endpoint.Parse(*csiEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "tcp" {
+		if *tlsCert != "" || *tlsKey != "" || *tlsClientCA != "" {
+			return nil, fmt.Errorf("TLS is only supported on tcp endpoints, not %s", *csiEndpoint)
+		}
+		return nil, nil
+	}
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsClientCA != "" {
+			return nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		if !*insecureTCP {
+			return nil, fmt.Errorf("refusing to serve %s without TLS, set --tls-cert and --tls-key or --allow-insecure-tcp", *csiEndpoint)
+		}
+		pkg.Log.Info("Serving without TLS", "endpoint", *csiEndpoint)
+		return nil, nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+	config, err := pkg.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// serveMetrics serves the Prometheus metrics at /metrics in the background.
+// The address of the returned server is the one listened on.
+func serveMetrics(address string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	pkg.Log.Info("Serving metrics", "address", server.Addr)
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			fatal(err, "Failed to serve metrics")
+		}
+	}()
+	return server, nil
+}
+
+// stopMetrics stops the metrics server, if any, letting running scrapes
+// finish within timeout.
+func stopMetrics(server *http.Server, timeout time.Duration) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		pkg.Log.Error(err, "Failed to stop serving metrics")
+		server.Close()
+	}
+}
+
+// flushTraces exports the spans still buffered.
+func flushTraces(shutdownTracing func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		pkg.Log.Error(err, "Failed to flush traces")
+	}
+}
+
+// shutdown stops accepting RPCs and waits for the in-flight ones, which may be
+// running lvcreate or virsh, for at most timeout before closing all connections.
+func shutdown(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		pkg.Log.Info("RPCs still running, stopping anyway", "timeout", timeout.String())
+		server.Stop()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+)
+
+// blockingIdentity is an identity service whose Probe runs until the client
+// or the server gives up.
+type blockingIdentity struct {
+	csi.UnimplementedIdentityServer
+	started chan struct{}
+}
+
+func (b *blockingIdentity) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func serveTest(t *testing.T, identity csi.IdentityServer) (*grpc.Server, csi.IdentityClient) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	csi.RegisterIdentityServer(server, identity)
+	go server.Serve(listener)
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return server, csi.NewIdentityClient(conn)
+}
+
+func TestShutdownIdle(t *testing.T) {
+	server, _ := serveTest(t, &csi.UnimplementedIdentityServer{})
+	start := time.Now()
+	shutdown(server, time.Minute)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutdown() of an idle server took %s", elapsed)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	identity := &blockingIdentity{started: make(chan struct{})}
+	server, client := serveTest(t, identity)
+	rpc := make(chan error, 1)
+	go func() {
+		_, err := client.Probe(context.Background(), &csi.ProbeRequest{})
+		rpc <- err
+	}()
+	<-identity.started
+
+	start := time.Now()
+	shutdown(server, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("shutdown() with a running RPC took %s, want the timeout", elapsed)
+	}
+	select {
+	case err := <-rpc:
+		if err == nil {
+			t.Error("RPC running at shutdown succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("RPC still running after shutdown")
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	server, err := serveMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "klc_gc_removed_volumes_total") {
+		t.Errorf("GET /metrics = %s, want the klc metrics", resp.Status)
+	}
+
+	stopMetrics(server, time.Second)
+	if _, err := http.Get("http://" + server.Addr + "/metrics"); err == nil {
+		t.Error("metrics still served after stopMetrics()")
+	}
+	// Nothing to stop without --metrics-address.
+	stopMetrics(nil, time.Second)
+
+	if _, err := serveMetrics("127.0.0.1:-1"); err == nil {
+		t.Error("serveMetrics() with an invalid address succeeded")
+	}
+}
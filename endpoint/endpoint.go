@@ -20,21 +20,37 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
+// Parse splits a CSI endpoint into the network and address for net.Listen.
+// unix:///csi/csi.sock and unix:/csi/csi.sock name the absolute path
+// /csi/csi.sock, unix://csi.sock and bare paths are relative to the working
+// directory. tcp://host:port listens on TCP.
 func Parse(ep string) (string, string, error) {
-	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
+	var proto, addr string
+	switch lower := strings.ToLower(ep); {
+	case strings.HasPrefix(lower, "unix://"), strings.HasPrefix(lower, "tcp://"):
 		s := strings.SplitN(ep, "://", 2)
-		if s[1] != "" {
-			return s[0], s[1], nil
-		}
+		proto, addr = strings.ToLower(s[0]), s[1]
+	case strings.HasPrefix(lower, "unix:"):
+		proto, addr = "unix", ep[len("unix:"):]
+	case strings.Contains(ep, "://"):
+		return "", "", fmt.Errorf("Invalid endpoint: %v: unsupported scheme", ep)
+	default:
+		// Assume everything else is a file path for a Unix Domain Socket.
+		proto, addr = "unix", ep
+	}
+	if addr == "" {
 		return "", "", fmt.Errorf("Invalid endpoint: %v", ep)
 	}
-	// Assume everything else is a file path for a Unix Domain Socket.
-	return "unix", ep, nil
+	return proto, addr, nil
 }
 
+// Listen listens on the endpoint. For unix sockets it creates the parent
+// directory, replaces a stale socket and restricts the socket to its owner and
+// group; cleanup removes it again.
 func Listen(endpoint string) (net.Listener, func(), error) {
 	proto, addr, err := Parse(endpoint)
 	if err != nil {
@@ -43,7 +59,9 @@ func Listen(endpoint string) (net.Listener, func(), error) {
 
 	cleanup := func() {}
 	if proto == "unix" {
-		addr = "/" + addr
+		if err := os.MkdirAll(filepath.Dir(addr), 0750); err != nil {
+			return nil, nil, fmt.Errorf("%s: %q", filepath.Dir(addr), err)
+		}
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) { //nolint: vetshadow
 			return nil, nil, fmt.Errorf("%s: %q", addr, err)
 		}
@@ -53,5 +71,15 @@ func Listen(endpoint string) (net.Listener, func(), error) {
 	}
 
 	l, err := net.Listen(proto, addr)
-	return l, cleanup, err
+	if err != nil {
+		return nil, nil, err
+	}
+	if proto == "unix" {
+		if err := os.Chmod(addr, 0660); err != nil {
+			l.Close()
+			cleanup()
+			return nil, nil, fmt.Errorf("%s: %q", addr, err)
+		}
+	}
+	return l, cleanup, nil
 }
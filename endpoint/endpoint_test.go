@@ -0,0 +1,77 @@
+package endpoint
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		wantProto string
+		wantAddr  string
+		wantErr   bool
+	}{
+		{endpoint: "unix:///csi/csi.sock", wantProto: "unix", wantAddr: "/csi/csi.sock"},
+		{endpoint: "UNIX:///csi/csi.sock", wantProto: "unix", wantAddr: "/csi/csi.sock"},
+		// Everything after unix:// is the path, which makes this one relative.
+		{endpoint: "unix://tmp/csi.sock", wantProto: "unix", wantAddr: "tmp/csi.sock"},
+		{endpoint: "unix://csi.sock", wantProto: "unix", wantAddr: "csi.sock"},
+		{endpoint: "unix:/csi/csi.sock", wantProto: "unix", wantAddr: "/csi/csi.sock"},
+		{endpoint: "unix:csi.sock", wantProto: "unix", wantAddr: "csi.sock"},
+		{endpoint: "/csi/csi.sock", wantProto: "unix", wantAddr: "/csi/csi.sock"},
+		{endpoint: "csi.sock", wantProto: "unix", wantAddr: "csi.sock"},
+		{endpoint: "tcp://127.0.0.1:10000", wantProto: "tcp", wantAddr: "127.0.0.1:10000"},
+		{endpoint: "unix://", wantErr: true},
+		{endpoint: "unix:", wantErr: true},
+		{endpoint: "tcp://", wantErr: true},
+		{endpoint: "", wantErr: true},
+		{endpoint: "http://127.0.0.1:10000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			proto, addr, err := Parse(tt.endpoint)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) = %q, %q, want an error", tt.endpoint, proto, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.endpoint, err)
+			}
+			if proto != tt.wantProto || addr != tt.wantAddr {
+				t.Errorf("Parse(%q) = %q, %q, want %q, %q", tt.endpoint, proto, addr, tt.wantProto, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "plugins", "csi.sock")
+	// A stale socket of a previous run is replaced.
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, cleanup, err := Listen("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %s, want a socket with 0660", info.Mode())
+	}
+	l.Close()
+	cleanup()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after cleanup: %v", err)
+	}
+}
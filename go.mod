@@ -3,13 +3,23 @@ module github.com/tivizi/kvm-lvm-csi
 go 1.16
 
 require (
-	github.com/container-storage-interface/spec v1.4.0
+	github.com/container-storage-interface/spec v1.5.0
+	github.com/go-logr/logr v1.2.0
 	github.com/gogo/status v1.1.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/kubernetes-csi/csi-lib-utils v0.9.1 // indirect
-	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
-	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
-	google.golang.org/grpc v1.37.0
+	github.com/golang/protobuf v1.5.2
+	github.com/kubernetes-csi/csi-lib-utils v0.9.1
+	github.com/peterbourgon/diskv v2.0.1+incompatible
+	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	google.golang.org/grpc v1.41.0
 	grpc.go4.org v0.0.0-20170609214715-11d0a25b4919
+	k8s.io/klog/v2 v2.30.0 // indirect
 	k8s.io/utils v0.0.0-20210305010621-2afb4311ab10
 )
@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCommandTimeout bounds the commands without a configured timeout.
+const DefaultCommandTimeout = 2 * time.Minute
+
+var (
+	defaultCommandTimeout = DefaultCommandTimeout
+	commandTimeouts       = map[string]time.Duration{}
+)
+
+// SetCommandTimeouts sets the timeout of all commands, and of the commands or
+// operations in timeouts. Keys are a command such as "lvcreate" or a command
+// and its operation such as "virsh:attach-device".
+func SetCommandTimeouts(defaultTimeout time.Duration, timeouts map[string]time.Duration) {
+	defaultCommandTimeout = defaultTimeout
+	commandTimeouts = timeouts
+}
+
+// ParseCommandTimeouts parses comma separated key=duration pairs for
+// SetCommandTimeouts, e.g. "lvcreate=5m,virsh:attach-device=30s".
+func ParseCommandTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid command timeout %q, expected command[:operation]=duration", pair)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid command timeout %q: not a positive duration", pair)
+		}
+		timeouts[kv[0]] = d
+	}
+	return timeouts, nil
+}
+
+// commandTimeout returns the timeout of the operation of the command.
+func commandTimeout(command, operation string) time.Duration {
+	if d, ok := commandTimeouts[command+":"+operation]; ok && operation != "" {
+		return d
+	}
+	if d, ok := commandTimeouts[command]; ok {
+		return d
+	}
+	return defaultCommandTimeout
+}
+
+// runCommand runs the command and returns its stdout. operation names the
+// subcommand in metrics, spans and timeouts, e.g. the virsh command. stdin is
+// passed to the command and never logged, it is how passphrases are handed
+// over. The command and its children are killed when ctx is done or its
+// timeout expires, the error then wraps the context error.
+// Failures are logged with the full stdout and stderr and returned with the
+// stderr of the command.
+func runCommand(ctx context.Context, command, operation string, stdin []byte, args ...string) (out []byte, err error) {
+	cmdPath, err := exec.LookPath(command)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found: %w", command, err)
+	}
+
+	name := command
+	if operation != "" {
+		name += " " + operation
+	}
+	timeout := commandTimeout(command, operation)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, done := startCommand(ctx, command, operation)
+	defer func() { done(err) }()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(cmdPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	// The command gets its own process group, so that the processes it
+	// started are killed with it and do not keep its output open.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	// A command that exited successfully just before ctx was done finished
+	// its work, only a failed one may have been killed.
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		logger(ctx).Error(ctxErr, "Command killed", "command", command, "args", args, "timeout", timeout.String(),
+			"stdout", stdout.String(), "stderr", stderr.String())
+		return stdout.Bytes(), fmt.Errorf("%s killed (timeout %s): %w", name, timeout, ctxErr)
+	}
+	if err != nil {
+		logger(ctx).Error(err, "Command failed", "command", command, "args", args,
+			"stdout", stdout.String(), "stderr", stderr.String())
+		return stdout.Bytes(), fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	logger(ctx).V(4).Info("Command succeeded", "command", command, "args", args)
+	return stdout.Bytes(), nil
+}
+
+// toStatus returns the gRPC status error for err. Timeouts and cancellations
+// keep their own code, so that the sidecars retry instead of giving up.
+func toStatus(code codes.Code, err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseCommandTimeouts(t *testing.T) {
+	got, err := ParseCommandTimeouts(" lvcreate=5m, ,virsh:attach-device=30s")
+	want := map[string]time.Duration{"lvcreate": 5 * time.Minute, "virsh:attach-device": 30 * time.Second}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCommandTimeouts() = %v, %v, want %v", got, err, want)
+	}
+	for _, s := range []string{"lvcreate", "=5m", "lvcreate=5", "lvcreate=-1s", "lvcreate=0s"} {
+		if _, err := ParseCommandTimeouts(s); err == nil {
+			t.Errorf("ParseCommandTimeouts(%q) passed", s)
+		}
+	}
+}
+
+// setCommandTimeouts sets the command timeouts for the duration of the test.
+func setCommandTimeouts(t *testing.T, defaultTimeout time.Duration, timeouts map[string]time.Duration) {
+	saved, savedTimeouts := defaultCommandTimeout, commandTimeouts
+	SetCommandTimeouts(defaultTimeout, timeouts)
+	t.Cleanup(func() { SetCommandTimeouts(saved, savedTimeouts) })
+}
+
+func TestCommandTimeout(t *testing.T) {
+	setCommandTimeouts(t, time.Minute, map[string]time.Duration{"virsh": time.Second, "virsh:attach-device": time.Hour})
+	for _, tc := range []struct {
+		command, operation string
+		want               time.Duration
+	}{
+		{"virsh", "attach-device", time.Hour},
+		{"virsh", "dumpxml", time.Second},
+		{"virsh", "", time.Second},
+		{"lvs", "", time.Minute},
+	} {
+		if got := commandTimeout(tc.command, tc.operation); got != tc.want {
+			t.Errorf("commandTimeout(%q, %q) = %v, want %v", tc.command, tc.operation, got, tc.want)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"hang": "sleep 10",
+		"ok":   "echo done",
+		"fail": "echo broken >&2; exit 3",
+		// detach exits at once, but a child outside its process group keeps
+		// its output open past the timeout.
+		"detach": "setsid sleep 1 &",
+	})
+	setCommandTimeouts(t, time.Minute, map[string]time.Duration{"hang": 100 * time.Millisecond, "detach": 100 * time.Millisecond})
+	ctx := context.Background()
+
+	start := time.Now()
+	if _, err := runCommand(ctx, "hang", "", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runCommand() of a hanging command = %v, want DeadlineExceeded", err)
+	}
+	// The sleep child is killed with the script instead of keeping its
+	// output open.
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("killed command returned after %v", d)
+	}
+
+	out, err := runCommand(ctx, "fail", "", nil)
+	if err == nil || !strings.HasSuffix(err.Error(), ": broken") || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runCommand() of a failing command = %q, %v, want the stderr", out, err)
+	}
+
+	if out, err := runCommand(ctx, "ok", "", nil); err != nil || string(out) != "done\n" {
+		t.Errorf("runCommand() = %q, %v, want the stdout", out, err)
+	}
+	// A command that succeeded is not reported as killed because its
+	// timeout expired by the time its output was read.
+	if _, err := runCommand(ctx, "detach", "", nil); err != nil {
+		t.Errorf("runCommand() of a command that exited before its timeout = %v", err)
+	}
+	if _, err := runCommand(ctx, "klc-missing-command", "", nil); err == nil {
+		t.Error("runCommand() of a missing command passed")
+	}
+}
+
+func TestToStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want codes.Code
+	}{
+		{errors.New("lvcreate: exit status 5"), codes.Internal},
+		{errors.New("lvs killed: " + context.DeadlineExceeded.Error()), codes.Internal},
+		{fmt.Errorf("lvs killed: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{fmt.Errorf("lvs killed: %w", context.Canceled), codes.Canceled},
+	} {
+		if got := status.Code(toStatus(codes.Internal, tc.err)); got != tc.want {
+			t.Errorf("toStatus(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package pkg
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -13,21 +16,40 @@ func (driver *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReq
 	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
-
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
-	if volume, err := driver.GetVolume(req.GetName()); err == nil {
-		return &csi.CreateVolumeResponse{
-			Volume: volume,
-		}, nil
+	params, err := ParseVolumeParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := driver.validateBus(&params.Disk); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
-	if volume, err := driver.NewVolume(req.GetName()); err == nil {
-		return &csi.CreateVolumeResponse{
-			Volume: volume,
-		}, nil
+	for _, capability := range req.GetVolumeCapabilities() {
+		if err := validateCapability(capability, params); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
 
-	return nil, status.Error(codes.Unavailable, "Create volume error")
+	if err := driver.lock(ctx); err != nil {
+		return nil, toStatus(codes.Aborted, err)
+	}
+	defer driver.unlock()
+	volume, err := driver.GetVolume(ctx, req.GetName())
+	if errors.Is(err, ErrVolumeNotFound) {
+		volume, err = driver.NewVolume(ctx, req.GetName(), params)
+	}
+	if errors.Is(err, ErrVolumeNotOwned) {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	}
+	if err != nil {
+		return nil, toStatus(codes.Unavailable, err)
+	}
+	volume.VolumeContext = VolumeContext(req.GetParameters())
+	return &csi.CreateVolumeResponse{
+		Volume: volume,
+	}, nil
 
 }
 
@@ -36,9 +58,28 @@ func (driver *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeReq
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
-	driver.DelVolume(req.GetVolumeId())
+	if err := driver.lock(ctx); err != nil {
+		return nil, toStatus(codes.Aborted, err)
+	}
+	defer driver.unlock()
+	// Volumes that are gone were deleted before. LVs of the same name the
+	// driver does not own are not the volume and are left alone. Untagged
+	// LVs may be volumes of a driver before the owner tag, which must not be
+	// reported deleted while they exist.
+	_, err := driver.GetVolume(ctx, req.GetVolumeId())
+	if errors.Is(err, ErrVolumeUntagged) {
+		return nil, toStatus(codes.FailedPrecondition, err)
+	}
+	if errors.Is(err, ErrVolumeNotFound) || errors.Is(err, ErrVolumeNotOwned) {
+		logger(ctx).V(3).Info("Volume does not exist, nothing to delete", "volume", req.GetVolumeId(), "reason", err.Error())
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, toStatus(codes.Unavailable, err)
+	}
+	if err := driver.DelVolume(ctx, req.GetVolumeId()); err != nil {
+		return nil, toStatus(codes.Internal, err)
+	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -53,6 +94,7 @@ func (driver *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Co
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 	var csc []*csi.ControllerServiceCapability
 
@@ -72,6 +114,27 @@ func (driver *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Co
 }
 
 func (driver *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	if _, err := driver.GetVolume(ctx, req.GetVolumeId()); errors.Is(err, ErrVolumeNotFound) || errors.Is(err, ErrVolumeNotOwned) {
+		return nil, toStatus(codes.NotFound, err)
+	} else if err != nil {
+		return nil, toStatus(codes.Unavailable, err)
+	}
+
+	params, err := ParseVolumeParameters(req.GetParameters())
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	for _, capability := range req.GetVolumeCapabilities() {
+		if err := validateCapability(capability, params); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeContext:      req.GetVolumeContext(),
@@ -81,22 +144,105 @@ func (driver *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.V
 	}, nil
 }
 
+// supportedAccessModes are the access modes of a LV attached to a single
+// domain, or shared read-only by several.
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    true,
+}
+
+// validateCapability checks that the volume can be used with the capability.
+func validateCapability(capability *csi.VolumeCapability, params *VolumeParameters) error {
+	mode := capability.GetAccessMode().GetMode()
+	if !supportedAccessModes[mode] {
+		return fmt.Errorf("access mode %s is not supported", mode)
+	}
+	mnt := capability.GetMount()
+	if mnt == nil {
+		if capability.GetBlock() == nil {
+			return errors.New("access type missing in volume capability")
+		}
+		return nil
+	}
+	fsType := mnt.GetFsType()
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	if err := validateMount(fsType, mnt.GetMountFlags()); err != nil {
+		return err
+	}
+	_, err := params.Mkfs.Args(fsType)
+	return err
+}
+
+// validateBus checks that the disk is attached on the bus of the attach mode.
+// The nodes report the volume limit of that bus, which disks on the other bus
+// would exceed.
+func (driver *Driver) validateBus(disk *DiskOptions) error {
+	if disk.Bus != "" && disk.Bus != driver.attachMode {
+		return fmt.Errorf("bus %s does not match the attach mode %s", disk.Bus, driver.attachMode)
+	}
+	return nil
+}
+
 func (driver *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	err := driver.AttachDisk(req.VolumeId, req.NodeId)
+	params, err := ParseVolumeParameters(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := driver.validateBus(&params.Disk); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The overrides are read on every publish, so that publishing an
+	// attached volume again applies changed limits.
+	iotune, err := driver.volumeIOTune(ctx, req.VolumeId, &params.IOTune)
+	if errors.Is(err, ErrInvalidIOTuneOverride) {
+		return nil, toStatus(codes.InvalidArgument, err)
+	}
+	if err != nil {
+		return nil, toStatus(codes.Unavailable, err)
+	}
+	if err := driver.lock(ctx); err != nil {
+		return nil, toStatus(codes.Aborted, err)
+	}
+	defer driver.unlock()
+	readOnly := req.GetReadonly() || isReadOnlyMode(req.GetVolumeCapability().GetAccessMode().GetMode())
+	meta, err := driver.AttachDisk(ctx, req.VolumeId, req.NodeId, &params.Disk, iotune, readOnly)
+	if errors.Is(err, ErrAttachedElsewhere) {
+		return nil, toStatus(codes.FailedPrecondition, err)
+	}
 	if err != nil {
-		return nil, status.Error(codes.Unavailable, err.Error())
+		return nil, toStatus(codes.Unavailable, err)
 	}
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{},
+		PublishContext: map[string]string{
+			PublishContextBus:      meta.Disk.Bus,
+			PublishContextSerial:   meta.Serial,
+			PublishContextReadOnly: strconv.FormatBool(meta.ReadOnly),
+		},
 	}, nil
 }
 
 func (driver *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	err := driver.DetachDisk(req.VolumeId, req.NodeId)
+	if err := driver.lock(ctx); err != nil {
+		return nil, toStatus(codes.Aborted, err)
+	}
+	defer driver.unlock()
+	// Only the attachment to the requested node goes, other readers keep theirs.
+	if meta, err := GetMeta(ctx, req.VolumeId); err != nil || meta.Attachments[req.NodeId] == nil {
+		logger(ctx).V(5).Info("Volume is not attached", "volume", req.VolumeId, "node", req.NodeId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	err := driver.DetachDisk(ctx, req.VolumeId, req.NodeId)
 	if err != nil {
-		return nil, status.Error(codes.Unavailable, err.Error())
+		return nil, toStatus(codes.Unavailable, err)
+	}
+	if err := RemoveAttachment(ctx, req.VolumeId, req.NodeId); err != nil {
+		return nil, toStatus(codes.Internal, err)
 	}
-	RemoveMeta(req.VolumeId)
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
@@ -107,22 +253,53 @@ func (driver *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityReque
 }
 
 func (driver *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return &csi.ListVolumesResponse{
-		Entries: []*csi.ListVolumesResponse_Entry{
-			&csi.ListVolumesResponse_Entry{
-				Volume: &csi.Volume{
-					VolumeId:      "test-volume",
-					CapacityBytes: 0xffffffff,
-				},
-				Status: &csi.ListVolumesResponse_VolumeStatus{
-					PublishedNodeIds: []string{"knode1"},
-					VolumeCondition: &csi.VolumeCondition{
-						Abnormal: false,
-						Message:  "it's ok",
-					},
+	lvs, err := driver.ListLogicalVolumes(ctx)
+	if err != nil {
+		return nil, toStatus(codes.Unavailable, err)
+	}
+
+	// Only volumes tagged as owned by this driver are listed.
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, lv := range lvs {
+		if !driver.OwnsVolume(lv) {
+			continue
+		}
+		var nodeIds []string
+		if meta, err := GetMeta(ctx, lv.Name); err == nil {
+			nodeIds = meta.NodeIds()
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      lv.Name,
+				CapacityBytes: lv.Size,
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: nodeIds,
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: false,
+					Message:  "it's ok",
 				},
 			},
-		},
+		})
+	}
+
+	start := 0
+	if req.GetStartingToken() != "" {
+		start, err = strconv.Atoi(req.GetStartingToken())
+		if err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.GetStartingToken())
+		}
+	}
+	end := len(entries)
+	nextToken := ""
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+		nextToken = strconv.Itoa(end)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
 	}, nil
 }
 
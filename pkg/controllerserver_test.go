@@ -0,0 +1,261 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode, fsType string, flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: flags}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func blockCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidateCapability(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability *csi.VolumeCapability
+		params     map[string]string
+		wantErr    bool
+	}{
+		{name: "single node writer", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "")},
+		{name: "single node multi writer", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, "xfs")},
+		{name: "multi node reader", capability: blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)},
+		{name: "multi node writer", capability: blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), wantErr: true},
+		{name: "multi node single writer", capability: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, ""), wantErr: true},
+		{name: "unknown mode", capability: mountCapability(csi.VolumeCapability_AccessMode_UNKNOWN, ""), wantErr: true},
+		{name: "no access type", capability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}, wantErr: true},
+		{name: "unsupported fsType", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "vfat"), wantErr: true},
+		{name: "mkfs option of another fsType", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, ""), params: map[string]string{ParamXFSReflink: "true"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ParseVolumeParameters(tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validateCapability(tt.capability, params); (err != nil) != tt.wantErr {
+				t.Errorf("validateCapability() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	fakeCommands(t, map[string]string{"lvs": lvsOutput([2]string{"pv-1", TagOwner + "test.csi"})})
+	driver := newTestDriver(t)
+	ctx := context.Background()
+
+	resp, err := driver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pv-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ext4")},
+	})
+	if err != nil || resp.Confirmed == nil {
+		t.Errorf("ValidateVolumeCapabilities() = %v, %v, want confirmed", resp, err)
+	}
+
+	resp, err = driver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pv-1",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+	})
+	if err != nil || resp.Confirmed != nil || resp.Message == "" {
+		t.Errorf("ValidateVolumeCapabilities() = %v, %v, want a message", resp, err)
+	}
+
+	_, err = driver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pv-missing",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("ValidateVolumeCapabilities() of a missing volume = %v, want NotFound", err)
+	}
+}
+
+func TestCreateVolumeUnsupportedAccessMode(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"lvs": lvsOutput(), "lvcreate": ""})
+	driver := newTestDriver(t)
+	_, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pv-1",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume() = %v, want InvalidArgument", err)
+	}
+	if got := readCalls(t, calls); len(got) != 0 {
+		t.Errorf("CreateVolume() ran %q", got)
+	}
+}
+
+func TestBusMismatch(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"lvs": lvsOutput(), "lvcreate": "", "virsh": fakeVirsh(map[string]string{"vm1": testDomainXML})})
+	driver := newTestDriver(t)
+	ctx := context.Background()
+	capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "")
+	params := map[string]string{ParamBus: BusSCSI}
+
+	// The nodes of the virtio test driver report the virtio volume limit.
+	if _, err := driver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pv-1",
+		Parameters:         params,
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume() with a SCSI bus = %v, want InvalidArgument", err)
+	}
+	if _, err := driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-1",
+		NodeId:           "vm1",
+		VolumeCapability: capability,
+		VolumeContext:    params,
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ControllerPublishVolume() with a SCSI bus = %v, want InvalidArgument", err)
+	}
+	if got := readCalls(t, calls); len(got) != 0 {
+		t.Errorf("volume with a SCSI bus ran %q", got)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	ctx := context.Background()
+	req := &csi.DeleteVolumeRequest{VolumeId: "pv-1"}
+	for _, tc := range []struct {
+		name, lvs, lvremove string
+		want                codes.Code
+		removed             bool
+	}{
+		{name: "owned", lvs: lvsOutput([2]string{"pv-1", TagOwner + "test.csi"}), want: codes.OK, removed: true},
+		{name: "missing", lvs: lvsOutput([2]string{"pv-2", TagOwner + "test.csi"}), want: codes.OK},
+		{name: "not owned", lvs: lvsOutput([2]string{"pv-1", TagOwner + "other.csi"}), want: codes.OK},
+		{name: "untagged", lvs: lvsOutput([2]string{"pv-1", ""}), want: codes.FailedPrecondition},
+		{name: "lvs failure", lvs: "exit 5", want: codes.Unavailable},
+		{name: "lvremove failure", lvs: lvsOutput([2]string{"pv-1", TagOwner + "test.csi"}), lvremove: "exit 5", want: codes.Internal, removed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := fakeCommands(t, map[string]string{"lvs": tc.lvs, "lvremove": tc.lvremove})
+			driver := newTestDriver(t)
+			if _, err := driver.DeleteVolume(ctx, req); status.Code(err) != tc.want {
+				t.Errorf("DeleteVolume() = %v, want %v", err, tc.want)
+			}
+			removed := false
+			for _, call := range readCalls(t, calls) {
+				removed = removed || call == "lvremove /dev/vg/pv-1 -y"
+			}
+			if removed != tc.removed {
+				t.Errorf("lvremove ran %v, want %v", removed, tc.removed)
+			}
+		})
+	}
+}
+
+// fakeVirsh returns a virsh script that prints the domain definitions for
+// dumpxml and accepts every other command.
+func fakeVirsh(domains map[string]string) string {
+	script := "case \"$1 $2\" in\n"
+	for name, domain := range domains {
+		script += "\"dumpxml " + name + "\") echo '" + domain + "' ;;\n"
+	}
+	return script + "esac"
+}
+
+func TestControllerPublishVolumeReadOnly(t *testing.T) {
+	fakeCommands(t, map[string]string{"virsh": fakeVirsh(map[string]string{"vm1": testDomainXML, "vm2": testDomainXML, "vm3": testDomainXML})})
+	driver := newTestDriver(t)
+	ctx := context.Background()
+	publish := func(volumeId, nodeId string, mode csi.VolumeCapability_AccessMode_Mode, readOnly bool) (map[string]string, error) {
+		resp, err := driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeId,
+			NodeId:           nodeId,
+			VolumeCapability: mountCapability(mode, ""),
+			Readonly:         readOnly,
+		})
+		return resp.GetPublishContext(), err
+	}
+
+	// A read-only publish attaches a read-only disk even for a writer access
+	// mode, and the node has to know.
+	pc, err := publish("pv-1", "vm1", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc[PublishContextReadOnly] != "true" || pc[PublishContextSerial] != diskSerial("pv-1") || pc[PublishContextBus] != BusVirtio {
+		t.Errorf("publish context = %v, want a read-only virtio disk", pc)
+	}
+	if _, err := publish("pv-1", "vm2", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false); err != nil {
+		t.Errorf("second read-only attachment failed: %v", err)
+	}
+
+	pc, err = publish("pv-2", "vm1", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc[PublishContextReadOnly] != "false" {
+		t.Errorf("publish context = %v, want a writable disk", pc)
+	}
+	if _, err := publish("pv-2", "vm3", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("attaching a writable volume elsewhere = %v, want FailedPrecondition", err)
+	}
+}
+
+// fakeIOTuneOverrides overrides the limits of the PersistentVolumes in the map.
+type fakeIOTuneOverrides map[string]*IOTune
+
+func (f fakeIOTuneOverrides) IOTuneOverride(ctx context.Context, pvName string) (*IOTune, error) {
+	return f[pvName], nil
+}
+
+func TestControllerPublishVolumeIOTuneOverride(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"virsh": fakeVirsh(map[string]string{"vm1": testDomainXML})})
+	driver := newTestDriver(t)
+	overrides := fakeIOTuneOverrides{"pv-1": {ReadIopsSec: 100}}
+	driver.iotuneOverrides = overrides
+	ctx := context.Background()
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-1",
+		NodeId:           "vm1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, ""),
+		VolumeContext:    map[string]string{ParamTotalIopsSec: "500"},
+	}
+	if _, err := driver.ControllerPublishVolume(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := GetMeta(ctx, "pv-1"); err != nil || meta.IOTune != (IOTune{ReadIopsSec: 100}) {
+		t.Errorf("attached limits = %+v, %v, want the override", meta, err)
+	}
+
+	// Publishing again applies and records a changed override.
+	overrides["pv-1"] = &IOTune{ReadIopsSec: 200}
+	if _, err := driver.ControllerPublishVolume(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := GetMeta(ctx, "pv-1"); err != nil || meta.IOTune != (IOTune{ReadIopsSec: 200}) {
+		t.Errorf("limits after publishing again = %+v, %v, want the changed override", meta, err)
+	}
+	applied := false
+	for _, call := range readCalls(t, calls) {
+		applied = applied || strings.Contains(call, "blkdeviotune vm1 vdb --live") && strings.Contains(call, "--read-iops-sec 200")
+	}
+	if !applied {
+		t.Error("changed override not applied with blkdeviotune")
+	}
+
+	// Without an override the StorageClass limits apply.
+	delete(overrides, "pv-1")
+	if _, err := driver.ControllerPublishVolume(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := GetMeta(ctx, "pv-1"); err != nil || meta.IOTune != (IOTune{TotalIopsSec: 500}) {
+		t.Errorf("limits without an override = %+v, %v, want the StorageClass ones", meta, err)
+	}
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// Cryptsetup manages LUKS devices on the node.
+// Passphrases are always passed via stdin, never on the command line.
+type Cryptsetup interface {
+	IsLuks(ctx context.Context, device string) (bool, error)
+	LuksFormat(ctx context.Context, device string, passphrase []byte) error
+	// LuksOpen maps the device to name, read-only when readOnly is set.
+	LuksOpen(ctx context.Context, device, name string, passphrase []byte, readOnly bool) error
+	LuksClose(ctx context.Context, name string) error
+	IsOpen(ctx context.Context, name string) (bool, error)
+}
+
+// NewCryptsetup returns a Cryptsetup that runs the cryptsetup binary.
+func NewCryptsetup() Cryptsetup {
+	return &execCryptsetup{}
+}
+
+type execCryptsetup struct{}
+
+func (c *execCryptsetup) run(ctx context.Context, stdin []byte, args ...string) error {
+	_, err := runCommand(ctx, "cryptsetup", args[0], stdin, args...)
+	return err
+}
+
+func (c *execCryptsetup) IsLuks(ctx context.Context, device string) (bool, error) {
+	err := c.run(ctx, nil, "isLuks", device)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *execCryptsetup) LuksFormat(ctx context.Context, device string, passphrase []byte) error {
+	return c.run(ctx, passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", device)
+}
+
+func (c *execCryptsetup) LuksOpen(ctx context.Context, device, name string, passphrase []byte, readOnly bool) error {
+	args := []string{"luksOpen", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	return c.run(ctx, passphrase, append(args, device, name)...)
+}
+
+func (c *execCryptsetup) LuksClose(ctx context.Context, name string) error {
+	return c.run(ctx, nil, "luksClose", name)
+}
+
+func (c *execCryptsetup) IsOpen(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(mapperPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func mapperPath(name string) string {
+	return "/dev/mapper/" + name
+}
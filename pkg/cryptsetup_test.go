@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCryptsetup is an in-memory Cryptsetup.
+type fakeCryptsetup struct {
+	mutex sync.Mutex
+	// Formatted maps LUKS formatted devices to their passphrase.
+	Formatted map[string][]byte
+	// Opened maps open mapper names to their backing device.
+	Opened map[string]string
+	// ReadOnly holds the mapper names opened read-only.
+	ReadOnly map[string]bool
+	// Formats counts the luksFormat calls.
+	Formats int
+}
+
+// newFakeCryptsetup returns an empty fakeCryptsetup.
+func newFakeCryptsetup() *fakeCryptsetup {
+	return &fakeCryptsetup{
+		Formatted: map[string][]byte{},
+		Opened:    map[string]string{},
+		ReadOnly:  map[string]bool{},
+	}
+}
+
+func (f *fakeCryptsetup) IsLuks(ctx context.Context, device string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, ok := f.Formatted[device]
+	return ok, nil
+}
+
+func (f *fakeCryptsetup) LuksFormat(ctx context.Context, device string, passphrase []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Formatted[device] = append([]byte{}, passphrase...)
+	f.Formats++
+	return nil
+}
+
+func (f *fakeCryptsetup) LuksOpen(ctx context.Context, device, name string, passphrase []byte, readOnly bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key, ok := f.Formatted[device]
+	if !ok {
+		return fmt.Errorf("%s is not a LUKS device", device)
+	}
+	if !bytes.Equal(key, passphrase) {
+		return errors.New("no key available with this passphrase")
+	}
+	f.Opened[name] = device
+	f.ReadOnly[name] = readOnly
+	return nil
+}
+
+func (f *fakeCryptsetup) LuksClose(ctx context.Context, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.Opened[name]; !ok {
+		return fmt.Errorf("device %s is not active", name)
+	}
+	delete(f.Opened, name)
+	delete(f.ReadOnly, name)
+	return nil
+}
+
+func (f *fakeCryptsetup) IsOpen(ctx context.Context, name string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, ok := f.Opened[name]
+	return ok, nil
+}
+
+// Device contents reported by the fake blkid.
+const (
+	blkidBlank = "exit 2"
+	blkidExt4  = "echo TYPE=ext4"
+)
+
+func newEncryptedTestDriver(t *testing.T, blkid string) (*Driver, *fakeCryptsetup) {
+	t.Helper()
+	fakeCommands(t, map[string]string{"blkid": blkid})
+	driver := newTestDriver(t)
+	crypt := newFakeCryptsetup()
+	driver.cryptsetup = crypt
+	return driver, crypt
+}
+
+func TestOpenEncryptedDevice(t *testing.T) {
+	driver, crypt := newEncryptedTestDriver(t, blkidBlank)
+	name := luksMapperName("pv-1")
+
+	for i := 0; i < 2; i++ {
+		if err := driver.openEncryptedDevice(context.Background(), "/dev/vdb", name, []byte("s3cret"), false); err != nil {
+			t.Fatalf("openEncryptedDevice() #%d: %v", i+1, err)
+		}
+	}
+	if crypt.Formats != 1 || !bytes.Equal(crypt.Formatted["/dev/vdb"], []byte("s3cret")) {
+		t.Errorf("formatted %d times with %q, want once with the passphrase", crypt.Formats, crypt.Formatted["/dev/vdb"])
+	}
+	if crypt.Opened[name] != "/dev/vdb" {
+		t.Errorf("mapping %s opened on %q, want /dev/vdb", name, crypt.Opened[name])
+	}
+
+	// Opening again after closing does not format the LUKS device again.
+	if err := crypt.LuksClose(context.Background(), name); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.openEncryptedDevice(context.Background(), "/dev/vdb", name, []byte("s3cret"), false); err != nil {
+		t.Fatal(err)
+	}
+	if crypt.Formats != 1 {
+		t.Errorf("LUKS device formatted again on reopen")
+	}
+}
+
+func TestOpenEncryptedDeviceErrors(t *testing.T) {
+	name := luksMapperName("pv-1")
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		driver, crypt := newEncryptedTestDriver(t, blkidBlank)
+		crypt.Formatted["/dev/vdb"] = []byte("s3cret")
+		err := driver.openEncryptedDevice(context.Background(), "/dev/vdb", name, []byte("guess"), false)
+		if err == nil || crypt.Formats != 0 || len(crypt.Opened) != 0 {
+			t.Errorf("openEncryptedDevice() = %v after %d formats, want an error without formatting", err, crypt.Formats)
+		}
+	})
+	t.Run("existing filesystem", func(t *testing.T) {
+		driver, crypt := newEncryptedTestDriver(t, blkidExt4)
+		if err := driver.openEncryptedDevice(context.Background(), "/dev/vdb", name, []byte("s3cret"), false); err == nil || crypt.Formats != 0 {
+			t.Errorf("openEncryptedDevice() = %v after %d formats, want a refusal", err, crypt.Formats)
+		}
+	})
+	t.Run("cryptsetup failure", func(t *testing.T) {
+		driver, _ := newEncryptedTestDriver(t, blkidBlank)
+		driver.cryptsetup = failingCryptsetup{newFakeCryptsetup()}
+		if err := driver.openEncryptedDevice(context.Background(), "/dev/vdb", name, []byte("s3cret"), false); err == nil {
+			t.Error("openEncryptedDevice() passed with a failing luksFormat")
+		}
+	})
+}
+
+// failingCryptsetup fails to format devices.
+type failingCryptsetup struct {
+	*fakeCryptsetup
+}
+
+func (failingCryptsetup) LuksFormat(ctx context.Context, device string, passphrase []byte) error {
+	return errors.New("device busy")
+}
+
+func TestStageEncryptedVolumeMissingPassphrase(t *testing.T) {
+	driver, crypt := newEncryptedTestDriver(t, blkidBlank)
+	_, err := driver.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pv-1",
+		StagingTargetPath: t.TempDir(),
+		VolumeContext:     map[string]string{ParamEncrypted: "true"},
+	})
+	if status.Code(err) != codes.InvalidArgument || crypt.Formats != 0 {
+		t.Errorf("NodeStageVolume() = %v after %d formats, want InvalidArgument", err, crypt.Formats)
+	}
+}
+
+func TestUnstageEncryptedVolume(t *testing.T) {
+	driver, crypt := newEncryptedTestDriver(t, blkidBlank)
+	name := luksMapperName("pv-1")
+	crypt.Opened[name] = "/dev/vdb"
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "pv-1", StagingTargetPath: t.TempDir()}
+	for i := 0; i < 2; i++ {
+		if _, err := driver.NodeUnstageVolume(context.Background(), req); err != nil {
+			t.Fatalf("NodeUnstageVolume() #%d: %v", i+1, err)
+		}
+	}
+	if _, open := crypt.Opened[name]; open {
+		t.Errorf("mapping %s still open after unstaging", name)
+	}
+}
+
+func encryptedStageRequest(t *testing.T, passphrase string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "pv-1",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		PublishContext:    map[string]string{PublishContextBus: BusVirtio, PublishContextSerial: diskSerial("pv-1")},
+		VolumeContext:     map[string]string{ParamEncrypted: "true"},
+		Secrets:           map[string]string{SecretPassphrase: passphrase},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+func TestStageEncryptedReadOnlyDisk(t *testing.T) {
+	ctx := context.Background()
+	device := guestDevicePath(BusVirtio, diskSerial("pv-1"))
+	name := luksMapperName("pv-1")
+
+	t.Run("LUKS device", func(t *testing.T) {
+		driver, crypt := newEncryptedTestDriver(t, blkidBlank)
+		crypt.Formatted[device] = []byte("s3cret")
+		req := encryptedStageRequest(t, "s3cret")
+		req.PublishContext[PublishContextReadOnly] = "true"
+		if _, err := driver.NodeStageVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if crypt.Opened[name] != device || !crypt.ReadOnly[name] {
+			t.Errorf("mapping %s opened on %q read-only %v, want read-only on %q", name, crypt.Opened[name], crypt.ReadOnly[name], device)
+		}
+	})
+	t.Run("blank device", func(t *testing.T) {
+		driver, crypt := newEncryptedTestDriver(t, blkidBlank)
+		req := encryptedStageRequest(t, "s3cret")
+		req.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+		if _, err := driver.NodeStageVolume(ctx, req); err == nil || crypt.Formats != 0 {
+			t.Errorf("NodeStageVolume() = %v after %d formats, want an error without formatting", err, crypt.Formats)
+		}
+	})
+}
+
+func TestExecCryptsetupLuksOpen(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"cryptsetup": "cat > /dev/null"})
+	crypt := NewCryptsetup()
+	ctx := context.Background()
+	if err := crypt.LuksOpen(ctx, "/dev/vdb", "klc-pv-1", []byte("s3cret"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := crypt.LuksOpen(ctx, "/dev/vdc", "klc-pv-2", []byte("s3cret"), true); err != nil {
+		t.Fatal(err)
+	}
+	// The passphrase goes through stdin only.
+	want := []string{
+		"cryptsetup luksOpen --key-file - /dev/vdb klc-pv-1",
+		"cryptsetup luksOpen --key-file - --readonly /dev/vdc klc-pv-2",
+	}
+	if got := readCalls(t, calls); !reflect.DeepEqual(got, want) {
+		t.Errorf("cryptsetup calls = %q, want %q", got, want)
+	}
+}
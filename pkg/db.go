@@ -1,71 +1,238 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/peterbourgon/diskv"
 )
 
+// VolumeMeta records how a volume is attached. Read-only volumes may be
+// attached to several domains, all other volumes to one at most.
 type VolumeMeta struct {
-	NodeId string
-	Name   string
+	// Attachments maps node ids to the disk attached to that domain.
+	Attachments map[string]*Attachment
+	Serial      string
+	Disk        DiskOptions
+	IOTune      IOTune
+	ReadOnly    bool
+
+	// NodeId, Name and Address are the single attachment of records
+	// written before Attachments existed.
+	NodeId  string        `json:",omitempty"`
+	Name    string        `json:",omitempty"`
+	Address *DriveAddress `json:",omitempty"`
+}
+
+// Attachment is the disk of a volume in one domain.
+type Attachment struct {
+	Name string
+	// Address is the drive address of SCSI disks.
+	Address *DriveAddress `json:",omitempty"`
+}
+
+// NodeIds returns the nodes the volume is attached to.
+func (meta *VolumeMeta) NodeIds() []string {
+	var nodeIds []string
+	for nodeId := range meta.Attachments {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Strings(nodeIds)
+	return nodeIds
+}
+
+var db = newStore("data")
+
+func newStore(dir string) *diskv.Diskv {
+	return diskv.New(diskv.Options{
+		BasePath:     dir,
+		Transform:    func(s string) []string { return []string{} },
+		CacheSizeMax: 1024 * 1024, // 1MB
+	})
 }
 
-var db = diskv.New(diskv.Options{
-	BasePath:     "data",
-	Transform:    func(s string) []string { return []string{} },
-	CacheSizeMax: 1024 * 1024, // 1MB
-})
+// SetMetadataDir stores the volume metadata in dir instead of ./data.
+func SetMetadataDir(dir string) {
+	lock.Lock()
+	defer lock.Unlock()
+	db = newStore(dir)
+}
 
 var lock sync.Mutex
 
-func NewMeta(volumeId, nodeId string) (*VolumeMeta, error) {
+// AddAttachment allocates a target name, and a SCSI address for SCSI disks,
+// that is free both in the metadata of the node and in the domain definition,
+// and records the attachment in the volume metadata.
+func AddAttachment(ctx context.Context, volumeId, nodeId string, meta *VolumeMeta, domain *domainXML) (attachment *Attachment, err error) {
+	ctx, done := startMetadata(ctx, "AddAttachment", volumeId)
+	defer func() { done(err) }()
 	lock.Lock()
 	defer lock.Unlock()
-	for i := 'b'; i < 'z'; i++ {
-		have := false
-		for _, meta := range ListMetas() {
-			if meta.Name == fmt.Sprintf("vd%c", i) && meta.NodeId == nodeId {
-				have = true
-			}
+
+	usedNames := map[string]bool{}
+	usedAddresses := map[DriveAddress]bool{}
+	for _, d := range domain.Devices.Disks {
+		usedNames[d.Target.Dev] = true
+		if address := d.driveAddress(); address != nil {
+			usedAddresses[*address] = true
 		}
-		if !have {
-			meta := VolumeMeta{
-				Name:   fmt.Sprintf("vd%c", i),
-				NodeId: nodeId,
+	}
+	for _, other := range ListMetas(ctx) {
+		used, ok := other.Attachments[nodeId]
+		if !ok {
+			continue
+		}
+		usedNames[used.Name] = true
+		if used.Address != nil {
+			usedAddresses[*used.Address] = true
+		}
+	}
+
+	attachment = &Attachment{}
+	if meta.Disk.Bus == BusSCSI {
+		attachment.Name = freeDiskName("sd", MaxSCSIVolumes, usedNames)
+		attachment.Address = freeSCSIAddress(domain, usedAddresses)
+		if attachment.Address == nil {
+			return nil, errors.New("no free SCSI address")
+		}
+	} else {
+		attachment.Name = freeDiskName("vd", MaxVirtioVolumes, usedNames)
+	}
+	if attachment.Name == "" {
+		return nil, errors.New("no free disk name")
+	}
+	if meta.Attachments == nil {
+		meta.Attachments = map[string]*Attachment{}
+	}
+	meta.Attachments[nodeId] = attachment
+	if err := SaveMeta(ctx, volumeId, meta); err != nil {
+		delete(meta.Attachments, nodeId)
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// RemoveAttachment forgets the attachment of the volume to the node, and the
+// whole volume metadata with its last attachment.
+func RemoveAttachment(ctx context.Context, volumeId, nodeId string) (err error) {
+	ctx, done := startMetadata(ctx, "RemoveAttachment", volumeId)
+	defer func() { done(err) }()
+	lock.Lock()
+	defer lock.Unlock()
+
+	meta, err := GetMeta(ctx, volumeId)
+	if err != nil {
+		return nil
+	}
+	delete(meta.Attachments, nodeId)
+	if len(meta.Attachments) == 0 {
+		return RemoveMeta(ctx, volumeId)
+	}
+	return SaveMeta(ctx, volumeId, meta)
+}
+
+// freeDiskName returns the first unused name of the count names after prefix+"a",
+// which is left to the boot disk.
+func freeDiskName(prefix string, count int, used map[string]bool) string {
+	for i := 1; i <= count; i++ {
+		name := prefix + diskLetters(i)
+		if !used[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// diskLetters returns the kernel style suffix of the disk with the index:
+// a, b, ..., z, aa, ab, ...
+func diskLetters(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('a'+(index-1)%26)) + name
+	}
+	return name
+}
+
+// freeSCSIAddress returns the first unused address on the driver's SCSI controllers.
+// Controller indexes taken by other SCSI controller models are skipped.
+func freeSCSIAddress(domain *domainXML, used map[DriveAddress]bool) *DriveAddress {
+	skip := map[int]bool{}
+	for _, c := range domain.Devices.Controllers {
+		if c.Type == "scsi" && c.Model != "virtio-scsi" {
+			skip[c.Index] = true
+		}
+	}
+	for controller := 0; controller < scsiControllers; controller++ {
+		if skip[controller] {
+			continue
+		}
+		for target := 0; target < scsiTargetsPerController; target++ {
+			address := DriveAddress{Type: "drive", Controller: controller, Target: target}
+			if !used[address] {
+				return &address
 			}
-			b, _ := json.Marshal(meta)
-			db.Write(volumeId, b)
-			return &meta, nil
 		}
 	}
-	return nil, errors.New("empty")
+	return nil
 }
 
-func GetMeta(volumeId string) (*VolumeMeta, error) {
+func GetMeta(ctx context.Context, volumeId string) (*VolumeMeta, error) {
+	_, done := startMetadata(ctx, "GetMeta", volumeId)
 	b, err := db.Read(volumeId)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
 	var meta VolumeMeta
 	json.Unmarshal(b, &meta)
+	meta.upgrade()
 	return &meta, nil
 }
 
-func RemoveMeta(volumeId string) error {
-	return db.Erase(volumeId)
+// upgrade moves the single attachment of old records into Attachments.
+func (meta *VolumeMeta) upgrade() {
+	if meta.NodeId == "" {
+		return
+	}
+	if meta.Attachments == nil {
+		meta.Attachments = map[string]*Attachment{}
+	}
+	meta.Attachments[meta.NodeId] = &Attachment{Name: meta.Name, Address: meta.Address}
+	meta.NodeId, meta.Name, meta.Address = "", "", nil
+}
+
+func SaveMeta(ctx context.Context, volumeId string, meta *VolumeMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, done := startMetadata(ctx, "SaveMeta", volumeId)
+	err = db.Write(volumeId, b)
+	done(err)
+	return err
+}
+
+func RemoveMeta(ctx context.Context, volumeId string) error {
+	_, done := startMetadata(ctx, "RemoveMeta", volumeId)
+	err := db.Erase(volumeId)
+	done(err)
+	return err
 }
 
-func ListMetas() []*VolumeMeta {
-	var metas []*VolumeMeta
+// ListMetas returns the metadata of every volume by volume id.
+func ListMetas(ctx context.Context) map[string]*VolumeMeta {
+	_, done := startMetadata(ctx, "ListMetas", "")
+	defer done(nil)
+	metas := map[string]*VolumeMeta{}
 	for key := range db.Keys(nil) {
 		b, _ := db.Read(key)
 		var meta VolumeMeta
 		json.Unmarshal(b, &meta)
-		metas = append(metas, &meta)
+		meta.upgrade()
+		metas[key] = &meta
 	}
 	return metas
 }
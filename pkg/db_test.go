@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+const testDomainXML = `<domain><devices>
+  <disk type="file" device="disk"><source file="/var/lib/libvirt/images/vm1.qcow2"/><target dev="vda" bus="virtio"/></disk>
+  <disk type="block" device="disk"><source dev="/dev/sdz"/><target dev="sda" bus="scsi"/><address type="drive" controller="0" bus="0" target="0" unit="0"/></disk>
+  <controller type="scsi" index="0" model="virtio-scsi"/>
+  <controller type="scsi" index="1" model="lsilogic"/>
+</devices></domain>`
+
+func parseTestDomain(t *testing.T, s string) *domainXML {
+	t.Helper()
+	var domain domainXML
+	if err := xml.Unmarshal([]byte(s), &domain); err != nil {
+		t.Fatal(err)
+	}
+	return &domain
+}
+
+func TestFreeDiskName(t *testing.T) {
+	if name := freeDiskName("vd", MaxVirtioVolumes, map[string]bool{"vda": true, "vdb": true}); name != "vdc" {
+		t.Errorf("freeDiskName() = %q, want vdc", name)
+	}
+	used := map[string]bool{}
+	for i := 1; i <= 26; i++ {
+		used[freeDiskName("sd", MaxSCSIVolumes, used)] = true
+	}
+	if name := freeDiskName("sd", MaxSCSIVolumes, used); name != "sdab" {
+		t.Errorf("freeDiskName() after sdz = %q, want sdab", name)
+	}
+	used = map[string]bool{}
+	for i := 0; i < MaxVirtioVolumes; i++ {
+		used[freeDiskName("vd", MaxVirtioVolumes, used)] = true
+	}
+	if name := freeDiskName("vd", MaxVirtioVolumes, used); name != "" {
+		t.Errorf("freeDiskName() with all names used = %q", name)
+	}
+}
+
+func TestFreeSCSIAddress(t *testing.T) {
+	domain := parseTestDomain(t, testDomainXML)
+	used := map[DriveAddress]bool{{Type: "drive", Controller: 0, Target: 0}: true}
+	if address := freeSCSIAddress(domain, used); *address != (DriveAddress{Type: "drive", Controller: 0, Target: 1}) {
+		t.Errorf("freeSCSIAddress() = %+v, want controller 0 target 1", address)
+	}
+	// Controller 1 is not virtio-scsi and is skipped.
+	for target := 0; target < scsiTargetsPerController; target++ {
+		used[DriveAddress{Type: "drive", Controller: 0, Target: target}] = true
+	}
+	if address := freeSCSIAddress(domain, used); address.Controller != 2 || address.Target != 0 {
+		t.Errorf("freeSCSIAddress() with controller 0 full = %+v, want controller 2 target 0", address)
+	}
+}
+
+func TestAddAttachment(t *testing.T) {
+	SetMetadataDir(t.TempDir())
+	ctx := context.Background()
+	domain := parseTestDomain(t, testDomainXML)
+
+	virtio, err := AddAttachment(ctx, "pv-1", "vm1", &VolumeMeta{Disk: DiskOptions{Bus: BusVirtio}}, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if virtio.Name != "vdb" || virtio.Address != nil {
+		t.Errorf("virtio attachment = %+v, want vdb without address", virtio)
+	}
+	scsi, err := AddAttachment(ctx, "pv-2", "vm1", &VolumeMeta{Disk: DiskOptions{Bus: BusSCSI}}, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scsi.Name != "sdb" || scsi.Address == nil || scsi.Address.Target != 1 {
+		t.Errorf("SCSI attachment = %+v, want sdb at target 1", scsi)
+	}
+	// Names recorded for the node are taken even if the domain does not show them yet.
+	next, err := AddAttachment(ctx, "pv-3", "vm1", &VolumeMeta{Disk: DiskOptions{Bus: BusVirtio}}, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Name != "vdc" {
+		t.Errorf("second virtio attachment = %q, want vdc", next.Name)
+	}
+	// Other nodes have their own names.
+	other, err := AddAttachment(ctx, "pv-4", "vm2", &VolumeMeta{Disk: DiskOptions{Bus: BusVirtio}}, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Name != "vdb" {
+		t.Errorf("attachment to vm2 = %q, want vdb", other.Name)
+	}
+
+	meta, err := GetMeta(ctx, "pv-1")
+	if err != nil || meta.Attachments["vm1"] == nil || meta.Attachments["vm1"].Name != "vdb" {
+		t.Fatalf("GetMeta() = %+v, %v, want the recorded attachment", meta, err)
+	}
+	if err := RemoveAttachment(ctx, "pv-1", "vm1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMeta(ctx, "pv-1"); err == nil {
+		t.Error("metadata kept after removing the last attachment")
+	}
+}
@@ -1,14 +1,17 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
 )
 
 // Driver Driver
@@ -17,55 +20,268 @@ type Driver struct {
 	version           string
 	nodeID            string
 	maxVolumesPerNode int64
-	mutex             sync.Mutex
+	attachMode        string
+	volumeGroup       string
+	libvirtURI        string
+	iotuneOverrides   IOTuneOverrides
+	cryptsetup        Cryptsetup
+	formatter         Formatter
+	// lockCh holds a token while a controller operation runs, a mutex
+	// that waiters can give up on.
+	lockCh chan struct{}
+
+	probeMutex  sync.RWMutex
+	probing     bool
+	probeChecks []ProbeCheck
+	probed      bool
+	probeErr    error
+	// probeRun is closed when the checks a Probe RPC runs before the first
+	// periodic result finish, nil while none run.
+	probeRun chan struct{}
+}
+
+// DefaultDriverName is the name the driver registers with by default.
+const DefaultDriverName = "kvm-lvm-csi"
+
+// Config configures a Driver.
+type Config struct {
+	Name    string
+	Version string
+	NodeID  string
+	// AttachMode is the bus disks are attached on, virtio or scsi, unless
+	// the StorageClass asks for another one.
+	AttachMode string
+	// VolumeGroup is the LVM volume group volumes are created in.
+	VolumeGroup string
+	// LibvirtURI is the libvirt connection URI, empty for the virsh default.
+	LibvirtURI string
+	// IOTuneOverrides replaces the StorageClass I/O limits of volumes, if
+	// set.
+	IOTuneOverrides IOTuneOverrides
 }
 
-func NewDriver(nodeId string) (*Driver, error) {
+// NewDriver returns the driver for the config, failing for incomplete configs.
+func NewDriver(config Config) (*Driver, error) {
+	if config.Name == "" {
+		return nil, errors.New("driver name not configured")
+	}
+	if config.Version == "" {
+		return nil, errors.New("driver version not configured")
+	}
+	if config.VolumeGroup == "" {
+		return nil, errors.New("volume group not configured")
+	}
+	var maxVolumesPerNode int64
+	switch config.AttachMode {
+	case BusVirtio:
+		maxVolumesPerNode = MaxVirtioVolumes
+	case BusSCSI:
+		maxVolumesPerNode = MaxSCSIVolumes
+	default:
+		return nil, fmt.Errorf("invalid attach mode %q", config.AttachMode)
+	}
 	return &Driver{
-		name:              "kvm-lvm-csi",
-		version:           "1.0.0",
-		nodeID:            nodeId,
-		maxVolumesPerNode: 1000,
+		name:              config.Name,
+		version:           config.Version,
+		nodeID:            config.NodeID,
+		maxVolumesPerNode: maxVolumesPerNode,
+		attachMode:        config.AttachMode,
+		volumeGroup:       config.VolumeGroup,
+		libvirtURI:        config.LibvirtURI,
+		iotuneOverrides:   config.IOTuneOverrides,
+		cryptsetup:        NewCryptsetup(),
+		formatter:         NewFormatter(),
+		lockCh:            make(chan struct{}, 1),
 	}, nil
 }
 
-func (driver *Driver) GetVolume(name string) (*csi.Volume, error) {
-	fmt.Println("GetVolume:", name)
-	cmdPath, err := exec.LookPath("lvs")
+// lock takes the driver lock, which serializes the controller operations,
+// unless ctx is done first. The wait is recorded as a span of the request.
+func (driver *Driver) lock(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "wait Driver.mutex")
+	defer span.End()
+	select {
+	case driver.lockCh <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		err := fmt.Errorf("waiting for another operation: %w", ctx.Err())
+		endSpan(span, err)
+		return err
+	}
+}
+
+// unlock releases the driver lock.
+func (driver *Driver) unlock() {
+	<-driver.lockCh
+}
+
+// lvPath returns the device path of the volume's LV on the hypervisor.
+func (driver *Driver) lvPath(volumeId string) string {
+	return "/dev/" + driver.volumeGroup + "/" + volumeId
+}
+
+// Tags set on every LV created by the driver.
+const (
+	TagOwner     = "klc/owner="
+	TagPV        = "klc/pv="
+	TagPVC       = "klc/pvc="
+	TagNamespace = "klc/namespace="
+	TagCreated   = "klc/created="
+)
+
+// LogicalVolume is a LV as reported by lvs.
+type LogicalVolume struct {
+	Name string
+	Size int64
+	Tags []string
+}
+
+// Tag returns the value of the tag with the given prefix.
+func (lv *LogicalVolume) Tag(prefix string) (string, bool) {
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix), true
+		}
+	}
+	return "", false
+}
+
+// ListLogicalVolumes returns the LVs of the volume group.
+func (driver *Driver) ListLogicalVolumes(ctx context.Context) ([]*LogicalVolume, error) {
+	out, err := runCommand(ctx, "lvs", "", nil, "--reportformat", "json", "--units", "b", "--nosuffix",
+		"-o", "lv_name,lv_size,lv_tags", driver.volumeGroup)
 	if err != nil {
-		return nil, fmt.Errorf("findmnt not found: %w", err)
+		return nil, err
 	}
+	var result struct {
+		Report []struct {
+			LV []struct {
+				Name string `json:"lv_name"`
+				Size string `json:"lv_size"`
+				Tags string `json:"lv_tags"`
+			} `json:"lv"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("parse lvs output: %w", err)
+	}
+	var lvs []*LogicalVolume
+	for _, report := range result.Report {
+		for _, vol := range report.LV {
+			lv := &LogicalVolume{Name: vol.Name}
+			lv.Size, _ = strconv.ParseInt(vol.Size, 10, 64)
+			if vol.Tags != "" {
+				lv.Tags = strings.Split(vol.Tags, ",")
+			}
+			lvs = append(lvs, lv)
+		}
+	}
+	return lvs, nil
+}
+
+// OwnsVolume reports whether the LV was created by this driver.
+func (driver *Driver) OwnsVolume(lv *LogicalVolume) bool {
+	owner, ok := lv.Tag(TagOwner)
+	return ok && owner == driver.name
+}
+
+// ErrVolumeNotFound is returned for volumes without a LV.
+var ErrVolumeNotFound = errors.New("volume not found")
 
-	out, err := exec.Command(cmdPath, "--reportformat", "json").CombinedOutput()
+// ErrVolumeNotOwned is returned for LVs another driver or an administrator
+// created with the name of a volume.
+var ErrVolumeNotOwned = errors.New("LV not owned by the driver")
+
+// ErrVolumeUntagged is returned for LVs without any owner tag, e.g. volumes
+// created before the driver tagged its LVs that AdoptVolumes did not adopt.
+var ErrVolumeUntagged = fmt.Errorf("%w: no %s tag", ErrVolumeNotOwned, TagOwner)
+
+// GetVolume returns the volume of the LV with the name, which has to carry
+// the owner tag of the driver.
+func (driver *Driver) GetVolume(ctx context.Context, name string) (*csi.Volume, error) {
+	logger(ctx).V(4).Info("Looking up volume", "volume", name)
+	lvs, err := driver.ListLogicalVolumes(ctx)
 	if err != nil {
-		glog.V(3).Infof("failed to execute command: %+v", cmdPath)
 		return nil, err
 	}
-	var result map[string]interface{}
-	json.Unmarshal(out, &result)
-	volList := result["report"].([]interface{})[0].(map[string]interface{})["lv"].([]interface{})
-	for _, vol := range volList {
-		lvName := vol.(map[string]interface{})["lv_name"].(string)
-		if lvName == "k8s-"+name {
+	for _, lv := range lvs {
+		if lv.Name == name {
+			if _, tagged := lv.Tag(TagOwner); !tagged {
+				return nil, fmt.Errorf("%s: %w", name, ErrVolumeUntagged)
+			}
+			if !driver.OwnsVolume(lv) {
+				return nil, fmt.Errorf("%s: %w", name, ErrVolumeNotOwned)
+			}
 			return &csi.Volume{
-				VolumeId: lvName,
+				VolumeId:      lv.Name,
+				CapacityBytes: lv.Size,
 			}, nil
 		}
 	}
-	return nil, errors.New("not found")
+	return nil, fmt.Errorf("%s: %w", name, ErrVolumeNotFound)
 }
 
-func (driver *Driver) NewVolume(name string) (*csi.Volume, error) {
-	fmt.Println("NewVolume", name)
-	cmdPath, err := exec.LookPath("lvcreate")
+// adoptableVolumeName matches the names the external-provisioner gives
+// volumes, pvc-<UID of the PersistentVolumeClaim>.
+var adoptableVolumeName = regexp.MustCompile(`^pvc-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// AdoptVolumes tags the untagged LVs named like volumes of the driver as owned
+// by it. Drivers before the owner tag created their LVs without tags, which
+// hides them from ListVolumes and the garbage collection. The creation time of
+// an adopted volume is the time of its adoption.
+func (driver *Driver) AdoptVolumes(ctx context.Context) error {
+	if err := driver.lock(ctx); err != nil {
+		return err
+	}
+	defer driver.unlock()
+	lvs, err := driver.ListLogicalVolumes(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("findmnt not found: %w", err)
+		return err
+	}
+	for _, lv := range lvs {
+		if _, tagged := lv.Tag(TagOwner); tagged || !adoptableVolumeName.MatchString(lv.Name) {
+			continue
+		}
+		// The external-provisioner names the volume after its PV.
+		args := []string{}
+		for _, tag := range driver.volumeTags(&VolumeParameters{PVName: lv.Name}) {
+			args = append(args, "--addtag", tag)
+		}
+		if _, err := runCommand(ctx, "lvchange", "", nil, append(args, driver.volumeGroup+"/"+lv.Name)...); err != nil {
+			return fmt.Errorf("adopt %s: %w", lv.Name, err)
+		}
+		logger(ctx).Info("Adopted untagged volume", "volume", lv.Name)
 	}
+	return nil
+}
 
+// volumeTags returns the LVM tags recording the ownership of a new volume.
+func (driver *Driver) volumeTags(params *VolumeParameters) []string {
+	tags := []string{
+		TagOwner + driver.name,
+		TagCreated + time.Now().UTC().Format(time.RFC3339),
+	}
+	if params.PVName != "" {
+		tags = append(tags, TagPV+params.PVName)
+	}
+	if params.PVCName != "" {
+		tags = append(tags, TagPVC+params.PVCName)
+	}
+	if params.PVCNamespace != "" {
+		tags = append(tags, TagNamespace+params.PVCNamespace)
+	}
+	return tags
+}
+
+func (driver *Driver) NewVolume(ctx context.Context, name string, params *VolumeParameters) (*csi.Volume, error) {
+	logger(ctx).Info("Creating volume", "volume", name)
 	lvName := name
-	_, err = exec.Command(cmdPath, "storages", "-n", lvName, "-L", "10G").CombinedOutput()
-	if err != nil {
-		glog.V(3).Infof("failed to execute command: %+v", cmdPath)
+	args := []string{driver.volumeGroup, "-n", lvName, "-L", "10G"}
+	for _, tag := range driver.volumeTags(params) {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, params.lvcreateArgs()...)
+	if _, err := runCommand(ctx, "lvcreate", "", nil, args...); err != nil {
 		return nil, err
 	}
 
@@ -74,53 +290,102 @@ func (driver *Driver) NewVolume(name string) (*csi.Volume, error) {
 	}, nil
 }
 
-func (driver *Driver) DelVolume(volumeId string) error {
-	fmt.Println("DelVolume:", volumeId)
-	cmdPath, err := exec.LookPath("lvremove")
-	if err != nil {
-		return fmt.Errorf("findmnt not found: %w", err)
-	}
+func (driver *Driver) DelVolume(ctx context.Context, volumeId string) error {
+	logger(ctx).Info("Deleting volume", "volume", volumeId)
+	_, err := runCommand(ctx, "lvremove", "", nil, driver.lvPath(volumeId), "-y")
+	return err
+}
 
-	_, err = exec.Command(cmdPath, "/dev/storages/"+volumeId, "-y").CombinedOutput()
-	if err != nil {
-		glog.V(3).Infof("failed to execute command: %+v", cmdPath)
-		return err
+// ErrAttachedElsewhere is returned when attaching a volume that is attached to
+// another node and cannot be shared.
+var ErrAttachedElsewhere = errors.New("volume is attached to another node")
+
+// AttachDisk attaches the volume to the domain. Read-only volumes can be
+// attached to several domains as long as every attachment is read-only.
+func (driver *Driver) AttachDisk(ctx context.Context, volumeId, nodeId string, disk *DiskOptions, iotune *IOTune, readOnly bool) (*VolumeMeta, error) {
+	log := logger(ctx).WithValues("volume", volumeId, "node", nodeId)
+	log.Info("Attaching volume")
+
+	meta, err := GetMeta(ctx, volumeId)
+	if err == nil {
+		if attachment, ok := meta.Attachments[nodeId]; ok {
+			// Already attached, a re-publish only updates the I/O limits.
+			// The disk settings of an attached disk cannot be changed.
+			if disk.Bus != "" && meta.Disk != *disk {
+				log.Info("Disk settings changed, keeping the current ones until the volume is reattached", "disk", meta.Disk)
+			}
+			if err := driver.SetIOTune(ctx, nodeId, attachment.Name, iotune); err != nil {
+				return nil, err
+			}
+			meta.IOTune = *iotune
+			return meta, SaveMeta(ctx, volumeId, meta)
+		}
+		if !readOnly || !meta.ReadOnly {
+			return nil, fmt.Errorf("%s: %w: %s", volumeId, ErrAttachedElsewhere, strings.Join(meta.NodeIds(), ","))
+		}
+	} else {
+		meta = &VolumeMeta{
+			Serial:   diskSerial(volumeId),
+			Disk:     *disk,
+			IOTune:   *iotune,
+			ReadOnly: readOnly,
+		}
+		if meta.Disk.Bus == "" {
+			meta.Disk.Bus = driver.attachMode
+		}
 	}
-	return nil
-}
 
-func (driver *Driver) AttachDisk(volumeId, nodeId string) error {
-	fmt.Println("AttachDisk:", volumeId, nodeId)
-	cmdPath, err := exec.LookPath("virsh")
+	domain, err := driver.DomainXML(ctx, nodeId)
 	if err != nil {
-		return fmt.Errorf("virsh not found: %w", err)
+		return nil, err
 	}
-
-	meta, err := NewMeta(volumeId, nodeId)
-	glog.Infof("VolumeMeta: %s", meta)
+	attachment, err := AddAttachment(ctx, volumeId, nodeId, meta, domain)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	log.Info("Allocated disk", "target", attachment.Name, "address", attachment.Address)
 
-	_, err = exec.Command(cmdPath, "attach-disk", nodeId, "/dev/storages/"+volumeId, meta.Name).CombinedOutput()
-	if err != nil {
-		glog.V(3).Infof("failed to execute command: %+v", cmdPath)
-		return err
+	if attachment.Address != nil {
+		if err := driver.ensureSCSIController(ctx, nodeId, domain, attachment.Address.Controller); err != nil {
+			RemoveAttachment(ctx, volumeId, nodeId)
+			return nil, err
+		}
 	}
-	return nil
+	if err := driver.AttachDevice(ctx, nodeId, newDiskXML(driver.lvPath(volumeId), meta, attachment)); err != nil {
+		RemoveAttachment(ctx, volumeId, nodeId)
+		return nil, err
+	}
+	return meta, nil
 }
 
-func (driver *Driver) DetachDisk(volumeId, nodeId string) error {
-	fmt.Println("DetachDisk: ", volumeId, nodeId)
-	cmdPath, err := exec.LookPath("virsh")
-	if err != nil {
-		return fmt.Errorf("virsh not found: %w", err)
+// volumeIOTune returns the I/O limits of the volume, the override of its
+// PersistentVolume if there is one and the StorageClass limits otherwise.
+func (driver *Driver) volumeIOTune(ctx context.Context, volumeId string, iotune *IOTune) (*IOTune, error) {
+	if driver.iotuneOverrides == nil {
+		return iotune, nil
 	}
-
-	_, err = exec.Command(cmdPath, "detach-disk", nodeId, "/dev/storages/"+volumeId).CombinedOutput()
+	// The external-provisioner names volumes after their PersistentVolume.
+	override, err := driver.iotuneOverrides.IOTuneOverride(ctx, volumeId)
 	if err != nil {
-		glog.V(3).Infof("failed to execute command: %+v", cmdPath)
-		return err
+		return nil, err
 	}
-	return nil
+	if override == nil {
+		return iotune, nil
+	}
+	logger(ctx).V(3).Info("Overriding the StorageClass I/O limits", "volume", volumeId)
+	return override, nil
+}
+
+// SetIOTune applies the I/O limits to the attached disk of the running domain.
+func (driver *Driver) SetIOTune(ctx context.Context, nodeId, target string, iotune *IOTune) error {
+	logger(ctx).Info("Setting I/O limits", "node", nodeId, "target", target)
+	args := append([]string{"blkdeviotune", nodeId, target, "--live"}, iotune.blkdeviotuneArgs()...)
+	_, err := runCommand(ctx, "virsh", "blkdeviotune", nil, driver.virshArgs(args...)...)
+	return err
+}
+
+func (driver *Driver) DetachDisk(ctx context.Context, volumeId, nodeId string) error {
+	logger(ctx).Info("Detaching volume", "volume", volumeId, "node", nodeId)
+	_, err := runCommand(ctx, "virsh", "detach-disk", nil, driver.virshArgs("detach-disk", nodeId, driver.lvPath(volumeId))...)
+	return err
 }
@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeTags(t *testing.T) {
+	driver := newTestDriver(t)
+	tags := driver.volumeTags(&VolumeParameters{PVName: "pv-1", PVCName: "data", PVCNamespace: "db"})
+	lv := &LogicalVolume{Name: "pv-1", Tags: tags}
+	for prefix, want := range map[string]string{TagOwner: "test.csi", TagPV: "pv-1", TagPVC: "data", TagNamespace: "db"} {
+		if got, _ := lv.Tag(prefix); got != want {
+			t.Errorf("tag %s = %q, want %q", prefix, got, want)
+		}
+	}
+	created, _ := lv.Tag(TagCreated)
+	if _, err := time.Parse(time.RFC3339, created); err != nil {
+		t.Errorf("tag %s = %q: %v", TagCreated, created, err)
+	}
+	for _, tag := range tags {
+		if len(tag) > maxLVMTagLength || !lvmTagPattern.MatchString(tag) {
+			t.Errorf("%q is not a valid LVM tag", tag)
+		}
+	}
+	if !driver.OwnsVolume(lv) {
+		t.Error("OwnsVolume() = false for a volume of the driver")
+	}
+	if driver.OwnsVolume(&LogicalVolume{Tags: []string{TagOwner + "other.csi"}}) {
+		t.Error("OwnsVolume() = true for a volume of another driver")
+	}
+}
+
+func TestGetVolumeOwner(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"lvs": lvsOutput([2]string{"pv-mine", TagOwner + "test.csi"}, [2]string{"pv-foreign", TagOwner + "other.csi"}, [2]string{"pv-admin", ""}),
+	})
+	driver := newTestDriver(t)
+	ctx := context.Background()
+
+	volume, err := driver.GetVolume(ctx, "pv-mine")
+	if err != nil || volume.VolumeId != "pv-mine" || volume.CapacityBytes != 1<<30 {
+		t.Errorf("GetVolume(pv-mine) = %v, %v", volume, err)
+	}
+	for _, name := range []string{"pv-foreign", "pv-admin"} {
+		if _, err := driver.GetVolume(ctx, name); !errors.Is(err, ErrVolumeNotOwned) {
+			t.Errorf("GetVolume(%s) error = %v, want ErrVolumeNotOwned", name, err)
+		}
+	}
+	if _, err := driver.GetVolume(ctx, "pv-admin"); !errors.Is(err, ErrVolumeUntagged) {
+		t.Errorf("GetVolume(pv-admin) error = %v, want ErrVolumeUntagged", err)
+	}
+	if _, err := driver.GetVolume(ctx, "pv-foreign"); errors.Is(err, ErrVolumeUntagged) {
+		t.Errorf("GetVolume(pv-foreign) error = %v, want a tagged LV", err)
+	}
+	if _, err := driver.GetVolume(ctx, "pv-missing"); !errors.Is(err, ErrVolumeNotFound) {
+		t.Errorf("GetVolume(pv-missing) error = %v, want ErrVolumeNotFound", err)
+	}
+}
+
+func TestCreateVolumeForeignLV(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{
+		"lvs":      lvsOutput([2]string{"pv-foreign", TagOwner + "other.csi"}),
+		"lvcreate": "",
+	})
+	driver := newTestDriver(t)
+	req := &csi.CreateVolumeRequest{
+		Name: "pv-foreign",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	}
+	_, err := driver.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("CreateVolume() error = %v, want AlreadyExists", err)
+	}
+	for _, call := range readCalls(t, calls) {
+		if strings.HasPrefix(call, "lvcreate") {
+			t.Errorf("CreateVolume() ran %q for a foreign LV", call)
+		}
+	}
+}
+
+func TestAdoptVolumes(t *testing.T) {
+	const untagged = "pvc-0b5a5e0e-8d2c-4d4e-9a1f-3c2b1a0f9e8d"
+	calls := fakeCommands(t, map[string]string{
+		"lvs": lvsOutput(
+			[2]string{untagged, ""},
+			[2]string{"pvc-11111111-2222-3333-4444-555555555555", TagOwner + "other.csi"},
+			[2]string{"pvc-66666666-7777-8888-9999-000000000000", TagOwner + "test.csi"},
+			[2]string{"root", ""},
+		),
+		"lvchange": "",
+	})
+	driver := newTestDriver(t)
+	if err := driver.AdoptVolumes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var adopted []string
+	for _, call := range readCalls(t, calls) {
+		if strings.HasPrefix(call, "lvchange ") {
+			adopted = append(adopted, call)
+		}
+	}
+	if len(adopted) != 1 {
+		t.Fatalf("lvchange ran %q, want the untagged volume only", adopted)
+	}
+	for _, want := range []string{"--addtag " + TagOwner + "test.csi", "--addtag " + TagPV + untagged, "--addtag " + TagCreated, " vg/" + untagged} {
+		if !strings.Contains(adopted[0], want) {
+			t.Errorf("lvchange ran %q, want %q", adopted[0], want)
+		}
+	}
+}
+
+func TestDriverConfigVolumeGroupAndLibvirtURI(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"lvs": lvsOutput(), "lvremove": "", "virsh": "echo '<domain/>'"})
+	SetMetadataDir(t.TempDir())
+	driver, err := NewDriver(Config{Name: "test.csi", Version: "1.0.0", AttachMode: BusVirtio, VolumeGroup: "guests", LibvirtURI: "qemu+ssh://hv1/system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := driver.ListLogicalVolumes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.DelVolume(ctx, "pv-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.DomainXML(ctx, "vm1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"lvs --reportformat json --units b --nosuffix -o lv_name,lv_size,lv_tags guests",
+		"lvremove /dev/guests/pv-1 -y",
+		"virsh --connect qemu+ssh://hv1/system dumpxml vm1",
+	}
+	if got := readCalls(t, calls); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCommands puts shell scripts with the given bodies first in PATH for the
+// duration of the test. Every call is appended to the returned file, one line
+// per call with the command name and its arguments.
+func fakeCommands(t *testing.T, scripts map[string]string) (calls string) {
+	t.Helper()
+	dir := t.TempDir()
+	calls = filepath.Join(dir, "calls")
+	for name, body := range scripts {
+		script := "#!/bin/sh\necho \"" + name + " $*\" >> " + calls + "\n" + body + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	return calls
+}
+
+// readCalls returns the calls recorded by the fake commands.
+func readCalls(t *testing.T, calls string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// lvsOutput returns the lvs JSON report of the LVs, given as name and tags.
+func lvsOutput(lvs ...[2]string) string {
+	var entries []string
+	for _, lv := range lvs {
+		entries = append(entries, `{"lv_name":"`+lv[0]+`","lv_size":"1073741824","lv_tags":"`+lv[1]+`"}`)
+	}
+	return `echo '{"report":[{"lv":[` + strings.Join(entries, ",") + `]}]}'`
+}
+
+// newTestDriver returns a controller driver with a metadata store of its own.
+func newTestDriver(t *testing.T) *Driver {
+	t.Helper()
+	SetMetadataDir(t.TempDir())
+	driver, err := NewDriver(Config{Name: "test.csi", Version: "1.0.0", NodeID: "vm1", AttachMode: BusVirtio, VolumeGroup: "vg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// Formatter creates filesystems on the node.
+type Formatter interface {
+	// GetFormat returns the filesystem on the device, "" if the device is blank.
+	GetFormat(ctx context.Context, device string) (string, error)
+	// Format creates a fsType filesystem on the device with extra mkfs arguments.
+	Format(ctx context.Context, device, fsType string, args []string) error
+}
+
+// NewFormatter returns a Formatter that runs blkid and mkfs.
+func NewFormatter() Formatter {
+	return &execFormatter{}
+}
+
+type execFormatter struct{}
+
+// partitionedFormat is the format of devices holding a partition table, which
+// are not blank either.
+const partitionedFormat = "unknown data, probably partitions"
+
+func (f *execFormatter) GetFormat(ctx context.Context, device string) (string, error) {
+	// -p probes the device itself instead of trusting the blkid cache.
+	out, err := runCommand(ctx, "blkid", "", nil, "-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", device)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		// Nothing found on the device.
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var fsType, ptType string
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "TYPE":
+			fsType = kv[1]
+		case "PTTYPE":
+			ptType = kv[1]
+		}
+	}
+	if fsType == "" && ptType != "" {
+		return partitionedFormat, nil
+	}
+	return fsType, nil
+}
+
+func (f *execFormatter) Format(ctx context.Context, device, fsType string, args []string) error {
+	// The device is known to be blank, force mkfs so it does not ask.
+	force := "-f"
+	if fsType == "ext3" || fsType == "ext4" {
+		force = "-F"
+	}
+	args = append(append([]string{force}, args...), device)
+	_, err := runCommand(ctx, "mkfs."+fsType, "", nil, args...)
+	return err
+}
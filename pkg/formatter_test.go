@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeFormatter is an in-memory Formatter.
+type fakeFormatter struct {
+	mutex sync.Mutex
+	// Formats maps devices to their filesystem.
+	Formats map[string]string
+	// Args records the mkfs arguments each device was formatted with.
+	Args map[string][]string
+}
+
+// newFakeFormatter returns a fakeFormatter with only blank devices.
+func newFakeFormatter() *fakeFormatter {
+	return &fakeFormatter{
+		Formats: map[string]string{},
+		Args:    map[string][]string{},
+	}
+}
+
+func (f *fakeFormatter) GetFormat(ctx context.Context, device string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.Formats[device], nil
+}
+
+func (f *fakeFormatter) Format(ctx context.Context, device, fsType string, args []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Formats[device] = fsType
+	f.Args[device] = append([]string{}, args...)
+	return nil
+}
+
+func TestMkfsOptionsArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsType  string
+		params  map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "ext4 defaults", fsType: "ext4"},
+		{name: "ext4", fsType: "ext4", params: map[string]string{ParamInodeRatio: "65536", ParamReservedBlocksPercentage: "0", ParamBlockSize: "4096"},
+			want: []string{"-i", "65536", "-m", "0", "-b", "4096"}},
+		{name: "ext4 reflink", fsType: "ext4", params: map[string]string{ParamXFSReflink: "true"}, wantErr: true},
+		{name: "xfs", fsType: "xfs", params: map[string]string{ParamXFSReflink: "false", ParamBlockSize: "4096"},
+			want: []string{"-m", "reflink=0", "-b", "size=4096"}},
+		{name: "xfs inode ratio", fsType: "xfs", params: map[string]string{ParamInodeRatio: "65536"}, wantErr: true},
+		{name: "xfs reserved blocks", fsType: "xfs", params: map[string]string{ParamReservedBlocksPercentage: "1"}, wantErr: true},
+		{name: "btrfs defaults", fsType: "btrfs"},
+		{name: "btrfs block size", fsType: "btrfs", params: map[string]string{ParamBlockSize: "4096"}, wantErr: true},
+		{name: "unsupported fsType", fsType: "vfat", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp, err := ParseVolumeParameters(tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args, err := vp.Mkfs.Args(tt.fsType)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Args(%q) = %q, want an error", tt.fsType, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Args(%q): %v", tt.fsType, err)
+			}
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("Args(%q) = %q, want %q", tt.fsType, args, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMkfsOptions(t *testing.T) {
+	for _, params := range []map[string]string{
+		{ParamInodeRatio: "0"},
+		{ParamBlockSize: "3000"},
+		{ParamReservedBlocksPercentage: "51"},
+		{ParamXFSReflink: "maybe"},
+	} {
+		if _, err := ParseVolumeParameters(params); err == nil {
+			t.Errorf("ParseVolumeParameters(%v) succeeded, want an error", params)
+		}
+	}
+}
+
+func TestFormatDevice(t *testing.T) {
+	ctx := context.Background()
+	xfs := map[string]string{ParamXFSReflink: "true"}
+	tests := []struct {
+		name          string
+		existing      string
+		fsType        string
+		volumeContext map[string]string
+		readOnly      bool
+		code          codes.Code
+		wantArgs      []string
+	}{
+		{name: "blank", fsType: "xfs", volumeContext: xfs, wantArgs: []string{"-m", "reflink=1"}},
+		{name: "already formatted", existing: "xfs", fsType: "xfs", volumeContext: xfs},
+		{name: "other filesystem", existing: "ext4", fsType: "xfs", code: codes.FailedPrecondition},
+		{name: "option of another filesystem", fsType: "ext4", volumeContext: xfs, code: codes.InvalidArgument},
+		{name: "blank read-only", fsType: "ext4", readOnly: true, code: codes.FailedPrecondition},
+		{name: "formatted read-only", existing: "ext4", fsType: "ext4", readOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatter := newFakeFormatter()
+			if tt.existing != "" {
+				formatter.Formats["/dev/vdb"] = tt.existing
+			}
+			driver := &Driver{formatter: formatter}
+			err := driver.formatDevice(ctx, "/dev/vdb", tt.fsType, tt.volumeContext, tt.readOnly)
+			if status.Code(err) != tt.code {
+				t.Fatalf("formatDevice() = %v, want %v", err, tt.code)
+			}
+			args, formatted := formatter.Args["/dev/vdb"]
+			if formatted != (tt.wantArgs != nil) || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("formatted with %q (%v), want %q", args, formatted, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestExecFormatterFormat(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"mkfs.ext4": "", "mkfs.xfs": "", "mkfs.btrfs": ""})
+	ctx := context.Background()
+	formatter := NewFormatter()
+	for _, fsType := range []string{"ext4", "xfs", "btrfs"} {
+		if err := formatter.Format(ctx, "/dev/vdb", fsType, []string{"-b", "4096"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"mkfs.ext4 -F -b 4096 /dev/vdb",
+		"mkfs.xfs -f -b 4096 /dev/vdb",
+		"mkfs.btrfs -f -b 4096 /dev/vdb",
+	}
+	if got := readCalls(t, calls); !reflect.DeepEqual(got, want) {
+		t.Errorf("mkfs calls = %q, want %q", got, want)
+	}
+}
+
+func TestExecFormatterGetFormat(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{"blkid": `case "$*" in
+*/dev/vdb) echo TYPE=xfs ;;
+*/dev/vdc) echo PTTYPE=gpt ;;
+*/dev/vdd) exit 2 ;;
+*) echo "no such device" >&2; exit 4 ;;
+esac`})
+	ctx := context.Background()
+	formatter := NewFormatter()
+	for device, want := range map[string]string{"/dev/vdb": "xfs", "/dev/vdc": partitionedFormat, "/dev/vdd": ""} {
+		if got, err := formatter.GetFormat(ctx, device); err != nil || got != want {
+			t.Errorf("GetFormat(%s) = %q, %v, want %q", device, got, err, want)
+		}
+	}
+	if _, err := formatter.GetFormat(ctx, "/dev/vde"); err == nil {
+		t.Error("GetFormat() of a failing blkid succeeded")
+	}
+	for _, call := range readCalls(t, calls) {
+		if !strings.HasPrefix(call, "blkid -p -s TYPE -s PTTYPE -o export /dev/") {
+			t.Errorf("blkid call = %q, want a probe of the device", call)
+		}
+	}
+}
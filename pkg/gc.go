@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"time"
+)
+
+// GCConfig configures the garbage collection of orphaned volumes.
+type GCConfig struct {
+	// Known lists the volumes in use, e.g. the handles of the PVs.
+	Known KnownVolumes
+	// GracePeriod is the age, from the klc/created= tag, volumes missing
+	// from Known must reach before they are removed. It covers volumes
+	// created whose PV does not exist yet.
+	GracePeriod time.Duration
+	// DryRun only reports the volumes that would be removed.
+	DryRun bool
+}
+
+// StartGC collects garbage now and then every interval.
+func (driver *Driver) StartGC(config GCConfig, interval time.Duration) {
+	go func() {
+		for {
+			if err := driver.CollectGarbage(context.Background(), config); err != nil {
+				Log.Error(err, "Garbage collection failed")
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// CollectGarbage removes the LVs owned by the driver that are missing from the
+// known volumes, older than the grace period and neither attached to a domain
+// nor recorded as attached. LVs without a creation time are never removed, and
+// nothing is when the known volumes or a domain cannot be read.
+func (driver *Driver) CollectGarbage(ctx context.Context, config GCConfig) (err error) {
+	ctx, span := tracer.Start(ctx, "gc")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+	ctx, log := withRequestID(ctx, "operation", "gc")
+	defer func() { observeGC(err) }()
+
+	if err := driver.lock(ctx); err != nil {
+		return err
+	}
+	defer driver.unlock()
+	known, err := config.Known.VolumeIDs(ctx)
+	if err != nil {
+		return err
+	}
+	log.V(3).Info("Collecting orphaned volumes", "known", len(known), "dryRun", config.DryRun)
+
+	lvs, err := driver.ListLogicalVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	attached, err := driver.attachedVolumes(ctx)
+	if err != nil {
+		return err
+	}
+
+	orphans := 0
+	for _, lv := range lvs {
+		if !driver.OwnsVolume(lv) || known[lv.Name] {
+			continue
+		}
+		volumeLog := log.WithValues("volume", lv.Name)
+		value, _ := lv.Tag(TagCreated)
+		created, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			volumeLog.Info("Skipping orphaned volume without a creation time", "created", value)
+			continue
+		}
+		age := time.Since(created)
+		if age < config.GracePeriod {
+			volumeLog.V(3).Info("Skipping orphaned volume within the grace period", "age", age.Round(time.Second).String())
+			continue
+		}
+		orphans++
+		if nodeIds := attached[lv.Name]; len(nodeIds) > 0 {
+			volumeLog.Info("Not removing orphaned volume, it is attached", "nodes", nodeIds)
+			continue
+		}
+		if config.DryRun {
+			volumeLog.Info("Would remove orphaned volume", "age", age.Round(time.Second).String(), "size", lv.Size)
+			continue
+		}
+		volumeLog.Info("Removing orphaned volume", "age", age.Round(time.Second).String(), "size", lv.Size)
+		if err := driver.DelVolume(ctx, lv.Name); err != nil {
+			volumeLog.Error(err, "Failed to remove orphaned volume")
+			continue
+		}
+		orphans--
+		gcRemoved.Inc()
+	}
+	gcOrphans.Set(float64(orphans))
+	return nil
+}
+
+// attachedVolumes returns the nodes every volume is attached to, according to
+// the definitions of all domains and to the attachment records.
+func (driver *Driver) attachedVolumes(ctx context.Context) (map[string][]string, error) {
+	attached := map[string][]string{}
+	nodeIds, err := driver.ListDomains(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, nodeId := range nodeIds {
+		disks, err := driver.domainVolumes(ctx, nodeId)
+		if err != nil {
+			return nil, err
+		}
+		for volumeId := range disks {
+			attached[volumeId] = append(attached[volumeId], nodeId)
+		}
+	}
+	for volumeId, meta := range ListMetas(ctx) {
+		for _, nodeId := range meta.NodeIds() {
+			if !contains(attached[volumeId], nodeId) {
+				attached[volumeId] = append(attached[volumeId], nodeId)
+			}
+		}
+	}
+	return attached, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testKnownVolumes is a source of known volumes that checks that it is
+// listed under the driver lock.
+type testKnownVolumes struct {
+	t      *testing.T
+	driver *Driver
+	ids    map[string]bool
+	err    error
+}
+
+func (k *testKnownVolumes) VolumeIDs(ctx context.Context) (map[string]bool, error) {
+	if len(k.driver.lockCh) == 0 {
+		k.t.Error("known volumes listed without holding the driver lock")
+	}
+	return k.ids, k.err
+}
+
+// gcTags returns the tags of a LV of the test driver created age ago.
+func gcTags(age time.Duration, extra ...string) string {
+	tags := []string{TagOwner + "test.csi", TagCreated + time.Now().Add(-age).UTC().Format(time.RFC3339)}
+	return strings.Join(append(tags, extra...), ",")
+}
+
+// fakeGCCommands fakes LVs covering every decision of the garbage collector,
+// with pv-attached attached to vm1.
+func fakeGCCommands(t *testing.T) string {
+	day := 24 * time.Hour
+	return fakeCommands(t, map[string]string{
+		"lvs": lvsOutput(
+			[2]string{"pv-orphan", gcTags(2 * day)},
+			[2]string{"pv-new", gcTags(time.Hour)},
+			[2]string{"pv-known", gcTags(2 * day)},
+			[2]string{"pv-attached", gcTags(2 * day)},
+			[2]string{"pv-recorded", gcTags(2 * day)},
+			[2]string{"pv-undated", TagOwner + "test.csi"},
+			[2]string{"other", TagCreated + "2020-01-01T00:00:00Z"},
+		),
+		"virsh": `case "$*" in
+"list --name --all") echo vm1; echo vm2 ;;
+"dumpxml vm1") echo '<domain><devices><disk type="block" device="disk"><source dev="/dev/vg/pv-attached"/><target dev="vdb" bus="virtio"/></disk></devices></domain>' ;;
+"dumpxml vm2") echo '<domain><devices></devices></domain>' ;;
+*) exit 1 ;;
+esac`,
+		"lvremove": "",
+	})
+}
+
+func newGCTestDriver(t *testing.T) (*Driver, *testKnownVolumes) {
+	t.Helper()
+	driver := newTestDriver(t)
+	if err := SaveMeta(context.Background(), "pv-recorded", &VolumeMeta{Attachments: map[string]*Attachment{"vm2": {Name: "vdb"}}}); err != nil {
+		t.Fatal(err)
+	}
+	known := &testKnownVolumes{t: t, driver: driver, ids: map[string]bool{"pv-known": true}}
+	return driver, known
+}
+
+func lvremoveCalls(t *testing.T, calls string) []string {
+	var removed []string
+	for _, call := range readCalls(t, calls) {
+		if strings.HasPrefix(call, "lvremove ") {
+			removed = append(removed, call)
+		}
+	}
+	return removed
+}
+
+func TestCollectGarbage(t *testing.T) {
+	calls := fakeGCCommands(t)
+	driver, known := newGCTestDriver(t)
+	removed := testutil.ToFloat64(gcRemoved)
+
+	if err := driver.CollectGarbage(context.Background(), GCConfig{Known: known, GracePeriod: 24 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lvremoveCalls(t, calls), []string{"lvremove /dev/vg/pv-orphan -y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lvremove calls = %q, want %q", got, want)
+	}
+	if got := testutil.ToFloat64(gcRemoved) - removed; got != 1 {
+		t.Errorf("%v volumes counted as removed, want 1", got)
+	}
+	// pv-attached and pv-recorded are orphaned but kept.
+	if got := testutil.ToFloat64(gcOrphans); got != 2 {
+		t.Errorf("orphaned volumes = %v, want 2", got)
+	}
+}
+
+func TestCollectGarbageDryRun(t *testing.T) {
+	calls := fakeGCCommands(t)
+	driver, known := newGCTestDriver(t)
+	if err := driver.CollectGarbage(context.Background(), GCConfig{Known: known, GracePeriod: 24 * time.Hour, DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lvremoveCalls(t, calls); len(got) != 0 {
+		t.Errorf("dry run ran %q", got)
+	}
+	if got := testutil.ToFloat64(gcOrphans); got != 3 {
+		t.Errorf("orphaned volumes = %v, want 3", got)
+	}
+}
+
+func TestCollectGarbageKnownVolumesError(t *testing.T) {
+	calls := fakeGCCommands(t)
+	driver, known := newGCTestDriver(t)
+	known.err = errors.New("persistentvolumes is forbidden")
+	if err := driver.CollectGarbage(context.Background(), GCConfig{Known: known}); err == nil {
+		t.Error("CollectGarbage() passed without known volumes")
+	}
+	if got := lvremoveCalls(t, calls); len(got) != 0 {
+		t.Errorf("CollectGarbage() without known volumes ran %q", got)
+	}
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/utils/mount"
+)
+
+// volumeCondition checks the health of a published volume on the node.
+// Filesystem volumes are checked at the staging path when it is mounted,
+// since the published path may be a read-only view on purpose.
+func volumeCondition(volumePath, stagingPath string, block bool) *csi.VolumeCondition {
+	if block {
+		return deviceCondition(volumePath)
+	}
+
+	mountPath := volumePath
+	if stagingPath != "" {
+		if notMnt, err := mount.IsNotMountPoint(mount.New(""), stagingPath); err == nil && !notMnt {
+			mountPath = stagingPath
+		}
+	}
+	mi, err := findMountPoint(mountPath)
+	if err != nil {
+		return abnormal("find mount of %s: %v", mountPath, err)
+	}
+	if mi == nil {
+		return abnormal("%s is not mounted", mountPath)
+	}
+	return filesystemCondition(mi)
+}
+
+// filesystemCondition checks the device and the filesystem of a mount.
+// Volumes staged or published read-only have ro in their per-mount options,
+// a filesystem the kernel remounted read-only after errors only has it in the
+// superblock options.
+func filesystemCondition(mi *mount.MountInfo) *csi.VolumeCondition {
+	if condition := deviceCondition(mi.Source); condition.Abnormal {
+		return condition
+	}
+	if hasOption(mi.SuperOptions, "ro") && !hasOption(mi.MountOptions, "ro") {
+		return abnormal("filesystem on %s was remounted read-only, probably after I/O errors", mi.Source)
+	}
+	if count := fsErrorCount(mi.Source); count > 0 {
+		return abnormal("filesystem on %s recorded %d errors", mi.Source, count)
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "it's ok from node",
+	}
+}
+
+// deviceCondition checks that the block device exists and has no I/O errors.
+func deviceCondition(device string) *csi.VolumeCondition {
+	if _, err := os.Stat(device); err != nil {
+		return abnormal("backing device %s is missing: %v", device, err)
+	}
+	if count := ioErrorCount(device); count > 0 {
+		return abnormal("device %s reported %d I/O errors", device, count)
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "it's ok from node",
+	}
+}
+
+func abnormal(format string, args ...interface{}) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// mountInfoPath is read for the per-mount and superblock options, which
+// /proc/mounts merges.
+var mountInfoPath = "/proc/self/mountinfo"
+
+func findMountPoint(path string) (*mount.MountInfo, error) {
+	mis, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	// The last entry wins for paths mounted over.
+	var found *mount.MountInfo
+	for i := range mis {
+		if mis[i].MountPoint == path {
+			found = &mis[i]
+		}
+	}
+	return found, nil
+}
+
+func hasOption(opts []string, option string) bool {
+	for _, opt := range opts {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// sysfsDir is where sysfs is mounted.
+var sysfsDir = "/sys"
+
+// kernelName returns the kernel name of the block device at path. The device
+// is found by its number, so that device nodes bind mounted onto other files,
+// like the target path of a block volume, resolve as well as symlinks.
+func kernelName(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", path)
+	}
+	rdev := uint64(st.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	link, err := os.Readlink(filepath.Join(sysfsDir, "dev", "block", fmt.Sprintf("%d:%d", major, minor)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+// kernelDevices returns the kernel names of the device and, for device mapper
+// devices such as LUKS mappings, of the devices below it.
+func kernelDevices(device string) []string {
+	name, err := kernelName(device)
+	if err != nil {
+		return nil
+	}
+	names := []string{name}
+	slaves, _ := ioutil.ReadDir(filepath.Join(sysfsDir, "block", name, "slaves"))
+	for _, slave := range slaves {
+		names = append(names, slave.Name())
+	}
+	return names
+}
+
+// ioErrorCount returns the I/O errors the SCSI layer counted for the device.
+// Neither virtio-blk nor device mapper devices count errors, so on the virtio
+// bus only the filesystem checks notice them.
+func ioErrorCount(device string) int64 {
+	var total int64
+	for _, name := range kernelDevices(device) {
+		total += readSysfsCounter(filepath.Join(sysfsDir, "block", name, "device", "ioerr_cnt"))
+	}
+	return total
+}
+
+// fsErrorCount returns the errors ext4 recorded for the filesystem on the device.
+func fsErrorCount(device string) int64 {
+	names := kernelDevices(device)
+	if len(names) == 0 {
+		return 0
+	}
+	return readSysfsCounter(filepath.Join(sysfsDir, "fs", "ext4", names[0], "errors_count"))
+}
+
+func readSysfsCounter(path string) int64 {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	count, _ := strconv.ParseInt(strings.TrimSpace(string(b)), 0, 64)
+	return count
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"k8s.io/utils/mount"
+)
+
+func TestFilesystemCondition(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "device")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		source       string
+		mountOptions []string
+		superOptions []string
+		wantAbnormal bool
+	}{
+		{name: "read-write", source: device, mountOptions: []string{"rw", "relatime"}, superOptions: []string{"rw"}},
+		{name: "read-only by request", source: device, mountOptions: []string{"ro", "relatime"}, superOptions: []string{"ro"}},
+		{name: "read-only view of a writable filesystem", source: device, mountOptions: []string{"ro"}, superOptions: []string{"rw"}},
+		{name: "remounted read-only after errors", source: device, mountOptions: []string{"rw"}, superOptions: []string{"ro", "errors=remount-ro"}, wantAbnormal: true},
+		{name: "missing device", source: filepath.Join(t.TempDir(), "missing"), mountOptions: []string{"rw"}, superOptions: []string{"rw"}, wantAbnormal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := filesystemCondition(&mount.MountInfo{Source: tt.source, MountOptions: tt.mountOptions, SuperOptions: tt.superOptions})
+			if condition.Abnormal != tt.wantAbnormal {
+				t.Errorf("filesystemCondition() = %v, want abnormal %v", condition, tt.wantAbnormal)
+			}
+		})
+	}
+}
+
+func TestDeviceConditionBlockTarget(t *testing.T) {
+	// The target of a block volume is a device node, not a symlink to
+	// the device, and named after the volume.
+	target := filepath.Join(t.TempDir(), "pv-1")
+	if err := syscall.Mknod(target, syscall.S_IFBLK|0600, 253<<8|7); err != nil {
+		t.Skipf("cannot create a device node: %v", err)
+	}
+	sysfs := t.TempDir()
+	saved := sysfsDir
+	sysfsDir = sysfs
+	t.Cleanup(func() { sysfsDir = saved })
+	for _, dir := range []string{"dev/block", "block/dm-7/slaves/sdb", "block/sdb/device"} {
+		if err := os.MkdirAll(filepath.Join(sysfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../../devices/virtual/block/dm-7", filepath.Join(sysfs, "dev/block/253:7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sysfs, "block/sdb/device/ioerr_cnt"), []byte("0x2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := kernelDevices(target); !reflect.DeepEqual(got, []string{"dm-7", "sdb"}) {
+		t.Errorf("kernelDevices() = %q, want the mapping and the disk below it", got)
+	}
+	if condition := deviceCondition(target); !condition.Abnormal {
+		t.Errorf("deviceCondition() = %v, want the I/O errors of the disk", condition)
+	}
+}
+
+func TestFindMountPoint(t *testing.T) {
+	setMountInfo(t, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+		"40 22 252:16 / /staging rw,relatime shared:20 - ext4 /dev/vdb rw\n"+
+		"41 40 252:32 / /staging rw,relatime shared:21 - xfs /dev/vdc ro\n")
+
+	mi, err := findMountPoint("/staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mount on top is the one in use.
+	if mi == nil || mi.Source != "/dev/vdc" || !hasOption(mi.SuperOptions, "ro") {
+		t.Errorf("findMountPoint() = %+v, want the /dev/vdc mount", mi)
+	}
+	if mi, err := findMountPoint("/missing"); mi != nil || err != nil {
+		t.Errorf("findMountPoint() of an unmounted path = %+v, %v", mi, err)
+	}
+}
+
+// setMountInfo replaces the mount table for the test.
+func setMountInfo(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := mountInfoPath
+	mountInfoPath = path
+	t.Cleanup(func() { mountInfoPath = old })
+}
@@ -18,14 +18,14 @@ package pkg
 
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 func (driver *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	glog.V(5).Infof("Using default GetPluginInfo")
+	logger(ctx).V(5).Info("Using default GetPluginInfo")
 
 	if driver.name == "" {
 		return nil, status.Error(codes.Unavailable, "Driver name not configured")
@@ -42,11 +42,17 @@ func (driver *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoR
 }
 
 func (driver *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	ready, err := driver.probe(ctx)
+	if err != nil {
+		logger(ctx).V(5).Info("Not ready", "reason", err.Error())
+	}
+	return &csi.ProbeResponse{
+		Ready: &wrappers.BoolValue{Value: ready},
+	}, nil
 }
 
 func (driver *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	glog.V(5).Infof("Using default capabilities")
+	logger(ctx).V(5).Info("Using default capabilities")
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestGetPluginInfo(t *testing.T) {
+	driver := newTestDriver(t)
+	resp, err := driver.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "test.csi" || resp.VendorVersion != "1.0.0" {
+		t.Errorf("GetPluginInfo() = %v, want test.csi 1.0.0", resp)
+	}
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	driver := newTestDriver(t)
+	resp, err := driver.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := map[csi.PluginCapability_Service_Type]bool{}
+	for _, capability := range resp.Capabilities {
+		services[capability.GetService().GetType()] = true
+	}
+	for _, want := range []csi.PluginCapability_Service_Type{
+		csi.PluginCapability_Service_CONTROLLER_SERVICE,
+		csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+	} {
+		if !services[want] {
+			t.Errorf("GetPluginCapabilities() does not report %s", want)
+		}
+	}
+}
+
+func TestNewDriverConfig(t *testing.T) {
+	valid := Config{Name: "test.csi", Version: "1.0.0", AttachMode: BusSCSI, VolumeGroup: "vg"}
+	driver, err := NewDriver(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver.maxVolumesPerNode != MaxSCSIVolumes {
+		t.Errorf("maxVolumesPerNode = %d in scsi mode, want %d", driver.maxVolumesPerNode, MaxSCSIVolumes)
+	}
+	for name, config := range map[string]Config{
+		"no name":         {Version: "1.0.0", AttachMode: BusVirtio, VolumeGroup: "vg"},
+		"no version":      {Name: "test.csi", AttachMode: BusVirtio, VolumeGroup: "vg"},
+		"no volume group": {Name: "test.csi", Version: "1.0.0", AttachMode: BusVirtio},
+		"bad attach mode": {Name: "test.csi", Version: "1.0.0", AttachMode: "ide", VolumeGroup: "vg"},
+		"no attach mode":  {Name: "test.csi", Version: "1.0.0", VolumeGroup: "vg"},
+	} {
+		if _, err := NewDriver(config); err == nil {
+			t.Errorf("NewDriver() with %s succeeded", name)
+		}
+	}
+}
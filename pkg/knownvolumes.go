@@ -0,0 +1,233 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// KnownVolumes lists the volumes that are still in use, the garbage collector
+// removes the driver's LVs missing from the list. They are listed under the
+// driver lock, so that volumes being created are known.
+type KnownVolumes interface {
+	// VolumeIDs returns the ids of the volumes in use. An error must be
+	// returned rather than an incomplete list.
+	VolumeIDs(ctx context.Context) (map[string]bool, error)
+}
+
+// ParseKnownVolumes returns the source of known volumes described by spec:
+// "kubernetes" for the volume handles of the driver's PersistentVolumes, or
+// "file:<path>" for a file with one volume id per line.
+func ParseKnownVolumes(spec, driverName string) (KnownVolumes, error) {
+	switch {
+	case spec == "kubernetes":
+		return NewKubernetesVolumes(driverName)
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		return NewFileVolumes(strings.TrimPrefix(spec, "file:")), nil
+	default:
+		return nil, fmt.Errorf("invalid known volumes source %q, expected kubernetes or file:<path>", spec)
+	}
+}
+
+type fileVolumes struct {
+	path string
+}
+
+// NewFileVolumes returns the volume ids listed in the file, one per line.
+// Empty lines and lines starting with # are ignored. The file is read again
+// on every call and must exist.
+func NewFileVolumes(path string) KnownVolumes {
+	return &fileVolumes{path: path}
+}
+
+func (f *fileVolumes) VolumeIDs(ctx context.Context) (map[string]bool, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ids := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", f.path, err)
+	}
+	return ids, nil
+}
+
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type kubernetesVolumes struct {
+	driverName string
+	server     string
+	client     *http.Client
+}
+
+// NewKubernetesVolumes returns the volume handles of the PersistentVolumes of
+// the driver, listed with the service account of the pod. It needs permission
+// to list persistentvolumes.
+func NewKubernetesVolumes(driverName string) (KnownVolumes, error) {
+	return newKubernetesVolumes(driverName)
+}
+
+// NewKubernetesIOTuneOverrides returns the I/O limits in the annotations of
+// the PersistentVolumes, read with the service account of the pod. It needs
+// permission to get persistentvolumes.
+func NewKubernetesIOTuneOverrides(driverName string) (IOTuneOverrides, error) {
+	return newKubernetesVolumes(driverName)
+}
+
+func newKubernetesVolumes(driverName string) (*kubernetesVolumes, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account CA")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	return &kubernetesVolumes{
+		driverName: driverName,
+		server:     "https://" + net.JoinHostPort(host, port),
+		client:     &http.Client{Transport: transport},
+	}, nil
+}
+
+func (k *kubernetesVolumes) VolumeIDs(ctx context.Context) (map[string]bool, error) {
+	ids := map[string]bool{}
+	err := k.eachPersistentVolume(ctx, func(pv *persistentVolume) {
+		if csi := pv.Spec.CSI; csi != nil && csi.Driver == k.driverName {
+			ids[csi.VolumeHandle] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+type persistentVolume struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		CSI *struct {
+			Driver       string `json:"driver"`
+			VolumeHandle string `json:"volumeHandle"`
+		} `json:"csi"`
+	} `json:"spec"`
+}
+
+type persistentVolumeList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []persistentVolume `json:"items"`
+}
+
+// eachPersistentVolume calls f for every PersistentVolume, reading all pages.
+func (k *kubernetesVolumes) eachPersistentVolume(ctx context.Context, f func(pv *persistentVolume)) error {
+	next := ""
+	for {
+		list, err := k.listPersistentVolumes(ctx, next)
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			f(&list.Items[i])
+		}
+		if next = list.Metadata.Continue; next == "" {
+			return nil
+		}
+	}
+}
+
+// listPersistentVolumes returns a page of PersistentVolumes.
+func (k *kubernetesVolumes) listPersistentVolumes(ctx context.Context, next string) (*persistentVolumeList, error) {
+	query := url.Values{"limit": {"500"}}
+	if next != "" {
+		query.Set("continue", next)
+	}
+	var list persistentVolumeList
+	if err := k.get(ctx, "/api/v1/persistentvolumes?"+query.Encode(), "list persistent volumes", &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// errKubernetesNotFound is returned by get for objects that do not exist.
+var errKubernetesNotFound = errors.New("not found")
+
+// get decodes the object at path of the API server into v. what describes the
+// request in errors.
+func (k *kubernetesVolumes) get(ctx context.Context, path, what string, v interface{}) error {
+	// The token is read on every call since Kubernetes rotates it.
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return fmt.Errorf("read service account token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", what, errKubernetesNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", what, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: parse response: %w", what, err)
+	}
+	return nil
+}
+
+// IOTuneOverride returns the limits of the annotations of the PersistentVolume
+// named <driver name>/<StorageClass parameter>, e.g. kvm-lvm-csi/readIopsSec.
+func (k *kubernetesVolumes) IOTuneOverride(ctx context.Context, pvName string) (*IOTune, error) {
+	var pv persistentVolume
+	err := k.get(ctx, "/api/v1/persistentvolumes/"+url.PathEscape(pvName), "get persistent volume "+pvName, &pv)
+	if errors.Is(err, errKubernetesNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	iotune, err := parseIOTuneAnnotations(pv.Metadata.Annotations, k.driverName+"/")
+	if err != nil {
+		return nil, fmt.Errorf("persistent volume %s: %w", pvName, err)
+	}
+	return iotune, nil
+}
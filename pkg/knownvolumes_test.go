@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileVolumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known")
+	content := "pv-1\n\n# decommissioned\n  pv-2  \n#pv-3\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := NewFileVolumes(path).VolumeIDs(context.Background())
+	if want := map[string]bool{"pv-1": true, "pv-2": true}; err != nil || !reflect.DeepEqual(ids, want) {
+		t.Errorf("VolumeIDs() = %v, %v, want %v", ids, err, want)
+	}
+
+	// A missing file is an error rather than no known volumes.
+	if ids, err := NewFileVolumes(filepath.Join(t.TempDir(), "missing")).VolumeIDs(context.Background()); err == nil {
+		t.Errorf("VolumeIDs() of a missing file = %v, want an error", ids)
+	}
+}
+
+func TestParseKnownVolumes(t *testing.T) {
+	if known, err := ParseKnownVolumes("file:/etc/klc/known", "test.csi"); err != nil || known.(*fileVolumes).path != "/etc/klc/known" {
+		t.Errorf("ParseKnownVolumes(file:) = %v, %v", known, err)
+	}
+	for _, spec := range []string{"", "file:", "configmap"} {
+		if _, err := ParseKnownVolumes(spec, "test.csi"); err == nil {
+			t.Errorf("ParseKnownVolumes(%q) passed", spec)
+		}
+	}
+}
+
+// persistentVolumePages are two pages of PersistentVolumes, one of another
+// driver and one without CSI source.
+var persistentVolumePages = map[string]string{
+	"": `{"metadata":{"continue":"page2"},"items":[
+  {"metadata":{"name":"pvc-1"},"spec":{"csi":{"driver":"test.csi","volumeHandle":"pv-1"}}},
+  {"metadata":{"name":"pvc-2"},"spec":{"csi":{"driver":"other.csi","volumeHandle":"pv-2"}}}]}`,
+	"page2": `{"metadata":{},"items":[
+  {"metadata":{"name":"pvc-3"},"spec":{"csi":{"driver":"test.csi","volumeHandle":"pv-3"}}},
+  {"metadata":{"name":"local"},"spec":{}}]}`,
+}
+
+func newTestKubernetesVolumes(t *testing.T, handler http.HandlerFunc) *kubernetesVolumes {
+	t.Helper()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("t0ken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := serviceAccountDir
+	serviceAccountDir = dir
+	t.Cleanup(func() { serviceAccountDir = saved })
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &kubernetesVolumes{driverName: "test.csi", server: server.URL, client: server.Client()}
+}
+
+func TestKubernetesVolumes(t *testing.T) {
+	k := newTestKubernetesVolumes(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/persistentvolumes" || r.Header.Get("Authorization") != "Bearer t0ken" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		page, ok := persistentVolumePages[r.URL.Query().Get("continue")]
+		if !ok {
+			http.Error(w, "expired", http.StatusGone)
+			return
+		}
+		w.Write([]byte(page))
+	})
+	ctx := context.Background()
+	ids, err := k.VolumeIDs(ctx)
+	if want := map[string]bool{"pv-1": true, "pv-3": true}; err != nil || !reflect.DeepEqual(ids, want) {
+		t.Errorf("VolumeIDs() = %v, %v, want %v", ids, err, want)
+	}
+}
+
+func TestKubernetesIOTuneOverride(t *testing.T) {
+	annotations := map[string]string{
+		"/api/v1/persistentvolumes/pvc-1": `{"test.csi/readIopsSec":"100","test.csi/writeIopsSec":"50","other.csi/totalIopsSec":"10"}`,
+		"/api/v1/persistentvolumes/pvc-2": `{"description":"no limits"}`,
+		"/api/v1/persistentvolumes/pvc-3": `{"test.csi/totalIopsSec":"10","test.csi/readIopsSec":"100"}`,
+	}
+	k := newTestKubernetesVolumes(t, func(w http.ResponseWriter, r *http.Request) {
+		a, ok := annotations[r.URL.Path]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"metadata":{"name":"` + path.Base(r.URL.Path) + `","annotations":` + a + `}}`))
+	})
+	ctx := context.Background()
+	iotune, err := k.IOTuneOverride(ctx, "pvc-1")
+	if want := (&IOTune{ReadIopsSec: 100, WriteIopsSec: 50}); err != nil || !reflect.DeepEqual(iotune, want) {
+		t.Errorf("IOTuneOverride(pvc-1) = %+v, %v, want %+v", iotune, err, want)
+	}
+	for _, name := range []string{"pvc-2", "pvc-missing"} {
+		if iotune, err := k.IOTuneOverride(ctx, name); iotune != nil || err != nil {
+			t.Errorf("IOTuneOverride(%s) = %+v, %v, want no override", name, iotune, err)
+		}
+	}
+	if _, err := k.IOTuneOverride(ctx, "pvc-3"); !errors.Is(err, ErrInvalidIOTuneOverride) {
+		t.Errorf("IOTuneOverride(pvc-3) error = %v, want ErrInvalidIOTuneOverride", err)
+	}
+}
+
+func TestKubernetesVolumesError(t *testing.T) {
+	k := newTestKubernetesVolumes(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("continue") == "" {
+			w.Write([]byte(persistentVolumePages[""]))
+			return
+		}
+		http.Error(w, "persistentvolumes is forbidden", http.StatusForbidden)
+	})
+	// A failed page fails the whole list instead of returning part of it.
+	if ids, err := k.VolumeIDs(context.Background()); err == nil {
+		t.Errorf("VolumeIDs() = %v, want an error", ids)
+	}
+}
+
+func TestNewKubernetesVolumesOutsidePod(t *testing.T) {
+	if host, ok := os.LookupEnv("KUBERNETES_SERVICE_HOST"); ok {
+		os.Unsetenv("KUBERNETES_SERVICE_HOST")
+		t.Cleanup(func() { os.Setenv("KUBERNETES_SERVICE_HOST", host) })
+	}
+	if _, err := NewKubernetesVolumes("test.csi"); err == nil {
+		t.Error("NewKubernetesVolumes() passed outside a pod")
+	}
+}
@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Disk buses supported for attached volumes.
+const (
+	BusVirtio = "virtio"
+	BusSCSI   = "scsi"
+)
+
+const (
+	// scsiControllers is the number of virtio-scsi controllers the driver
+	// attaches disks to, created on demand.
+	scsiControllers = 4
+	// scsiTargetsPerController is the number of targets used per controller,
+	// each disk gets its own target with unit 0.
+	scsiTargetsPerController = 256
+
+	// MaxVirtioVolumes is the number of virtio disks per domain, vdb to vdy.
+	MaxVirtioVolumes = 24
+	// MaxSCSIVolumes is the number of SCSI disks per domain.
+	MaxSCSIVolumes = scsiControllers * scsiTargetsPerController
+)
+
+// DriveAddress is the libvirt drive <address> of a SCSI disk.
+type DriveAddress struct {
+	Type       string `xml:"type,attr"`
+	Controller int    `xml:"controller,attr"`
+	Bus        int    `xml:"bus,attr"`
+	Target     int    `xml:"target,attr"`
+	Unit       int    `xml:"unit,attr"`
+}
+
+// diskXML is the libvirt <disk> element of an attached volume.
+type diskXML struct {
+	XMLName xml.Name `xml:"disk"`
+	Type    string   `xml:"type,attr"`
+	Device  string   `xml:"device,attr"`
+	Driver  struct {
+		Name         string `xml:"name,attr"`
+		Type         string `xml:"type,attr"`
+		Cache        string `xml:"cache,attr,omitempty"`
+		IO           string `xml:"io,attr,omitempty"`
+		Discard      string `xml:"discard,attr,omitempty"`
+		DetectZeroes string `xml:"detect_zeroes,attr,omitempty"`
+	} `xml:"driver"`
+	Source struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr,omitempty"`
+	} `xml:"target"`
+	IOTune    *IOTune       `xml:"iotune,omitempty"`
+	ReadOnly  *struct{}     `xml:"readonly"`
+	Shareable *struct{}     `xml:"shareable"`
+	Serial    string        `xml:"serial,omitempty"`
+	Address   *DriveAddress `xml:"address,omitempty"`
+}
+
+// controllerXML is a libvirt <controller> element.
+type controllerXML struct {
+	XMLName xml.Name `xml:"controller"`
+	Type    string   `xml:"type,attr"`
+	Index   int      `xml:"index,attr"`
+	Model   string   `xml:"model,attr,omitempty"`
+}
+
+// domainXML is the part of the libvirt domain definition the driver looks at.
+type domainXML struct {
+	Devices struct {
+		Disks       []domainDiskXML `xml:"disk"`
+		Controllers []controllerXML `xml:"controller"`
+	} `xml:"devices"`
+}
+
+// domainDiskXML is a <disk> of the domain definition. The address attributes
+// are kept as strings since PCI addresses are hexadecimal.
+type domainDiskXML struct {
+	Source struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"target"`
+	Address *struct {
+		Type       string `xml:"type,attr"`
+		Controller string `xml:"controller,attr"`
+		Bus        string `xml:"bus,attr"`
+		Target     string `xml:"target,attr"`
+		Unit       string `xml:"unit,attr"`
+	} `xml:"address"`
+}
+
+// driveAddress returns the drive address of the disk, if it has one.
+func (d *domainDiskXML) driveAddress() *DriveAddress {
+	if d.Address == nil || d.Address.Type != "drive" {
+		return nil
+	}
+	address := &DriveAddress{Type: "drive"}
+	address.Controller, _ = strconv.Atoi(d.Address.Controller)
+	address.Bus, _ = strconv.Atoi(d.Address.Bus)
+	address.Target, _ = strconv.Atoi(d.Address.Target)
+	address.Unit, _ = strconv.Atoi(d.Address.Unit)
+	return address
+}
+
+// newDiskXML returns the <disk> element attaching the volume with the recorded settings.
+// Read-only volumes are attached shareable so that several domains can use them.
+func newDiskXML(source string, meta *VolumeMeta, attachment *Attachment) *diskXML {
+	disk := &diskXML{Type: "block", Device: "disk"}
+	disk.Driver.Name = "qemu"
+	disk.Driver.Type = "raw"
+	disk.Driver.Cache = meta.Disk.Cache
+	disk.Driver.IO = meta.Disk.IO
+	disk.Driver.Discard = meta.Disk.Discard
+	disk.Driver.DetectZeroes = meta.Disk.DetectZeroes
+	disk.Source.Dev = source
+	disk.Target.Dev = attachment.Name
+	disk.Target.Bus = meta.Disk.Bus
+	disk.Serial = meta.Serial
+	disk.Address = attachment.Address
+	if meta.ReadOnly {
+		disk.ReadOnly = &struct{}{}
+		disk.Shareable = &struct{}{}
+	}
+	if !meta.IOTune.IsZero() {
+		iotune := meta.IOTune
+		disk.IOTune = &iotune
+	}
+	return disk
+}
+
+// diskSerial returns the serial number the volume is attached with.
+// virtio-blk serials are limited to 20 characters, too short for PV names.
+func diskSerial(volumeId string) string {
+	sum := sha256.Sum256([]byte(volumeId))
+	return "klc" + hex.EncodeToString(sum[:])[:17]
+}
+
+// guestDevicePath returns the udev by-id path of a disk inside the guest.
+func guestDevicePath(bus, serial string) string {
+	if bus == BusSCSI {
+		return "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_" + serial
+	}
+	return "/dev/disk/by-id/virtio-" + serial
+}
+
+// virshArgs prepends the connection URI to the virsh arguments.
+func (driver *Driver) virshArgs(args ...string) []string {
+	if driver.libvirtURI == "" {
+		return args
+	}
+	return append([]string{"--connect", driver.libvirtURI}, args...)
+}
+
+// DomainXML returns the live definition of the domain.
+func (driver *Driver) DomainXML(ctx context.Context, nodeId string) (*domainXML, error) {
+	out, err := runCommand(ctx, "virsh", "dumpxml", nil, driver.virshArgs("dumpxml", nodeId)...)
+	if err != nil {
+		return nil, err
+	}
+	var domain domainXML
+	if err := xml.Unmarshal(out, &domain); err != nil {
+		return nil, fmt.Errorf("parse domain %s: %w", nodeId, err)
+	}
+	return &domain, nil
+}
+
+// ListDomains returns the names of the running domains, or of all defined
+// domains when all is set.
+func (driver *Driver) ListDomains(ctx context.Context, all bool) ([]string, error) {
+	args := []string{"list", "--name"}
+	if all {
+		args = append(args, "--all")
+	}
+	out, err := runCommand(ctx, "virsh", "list", nil, driver.virshArgs(args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// AttachDevice hot plugs the device described by the XML element into the running domain.
+func (driver *Driver) AttachDevice(ctx context.Context, nodeId string, device interface{}) error {
+	b, err := xml.MarshalIndent(device, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "klc-device-*.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	_, err = runCommand(ctx, "virsh", "attach-device", nil, driver.virshArgs("attach-device", nodeId, f.Name(), "--live")...)
+	return err
+}
+
+// ensureSCSIController makes sure the domain has the virtio-scsi controller
+// with the index, adding it if needed.
+func (driver *Driver) ensureSCSIController(ctx context.Context, nodeId string, domain *domainXML, index int) error {
+	for _, c := range domain.Devices.Controllers {
+		if c.Type == "scsi" && c.Index == index {
+			return nil
+		}
+	}
+	logger(ctx).Info("Adding virtio-scsi controller", "node", nodeId, "index", index)
+	return driver.AttachDevice(ctx, nodeId, &controllerXML{Type: "scsi", Index: index, Model: "virtio-scsi"})
+}
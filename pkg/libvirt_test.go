@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestNewDiskXML(t *testing.T) {
+	meta := &VolumeMeta{
+		Serial: diskSerial("pv-1"),
+		Disk:   DiskOptions{Bus: BusVirtio, Cache: "none", IO: "native", Discard: "unmap"},
+	}
+	out, err := xml.Marshal(newDiskXML("/dev/vg/pv-1", meta, &Attachment{Name: "vdb"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<driver name="qemu" type="raw" cache="none" io="native" discard="unmap"></driver>`,
+		`<source dev="/dev/vg/pv-1"></source>`,
+		`<target dev="vdb" bus="virtio"></target>`,
+		`<serial>` + meta.Serial + `</serial>`,
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("disk XML %s does not contain %s", out, want)
+		}
+	}
+	// Unset options are left to libvirt.
+	for _, unwanted := range []string{"detect_zeroes", "<iotune", "<readonly", "<address"} {
+		if strings.Contains(string(out), unwanted) {
+			t.Errorf("disk XML %s contains %s", out, unwanted)
+		}
+	}
+}
+
+func TestDiskSerial(t *testing.T) {
+	serial := diskSerial("pvc-0a1b2c3d-4e5f-6789-abcd-ef0123456789")
+	// virtio-blk truncates serials to 20 characters.
+	if len(serial) != 20 || !strings.HasPrefix(serial, "klc") {
+		t.Errorf("diskSerial() = %q, want 20 characters starting with klc", serial)
+	}
+	if serial == diskSerial("pvc-0a1b2c3d-4e5f-6789-abcd-ef012345678a") {
+		t.Errorf("diskSerial() is the same for different volumes")
+	}
+}
+
+func TestNewDiskXMLReadOnly(t *testing.T) {
+	meta := &VolumeMeta{Serial: diskSerial("pv-1"), Disk: DiskOptions{Bus: BusVirtio}, ReadOnly: true}
+	out, err := xml.Marshal(newDiskXML("/dev/vg/pv-1", meta, &Attachment{Name: "vdb"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Several domains can only share the disk when it is shareable.
+	if !strings.Contains(string(out), "<readonly></readonly><shareable></shareable>") {
+		t.Errorf("disk XML %s is not read-only and shareable", out)
+	}
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/golang/glog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats selected by SetupLogging.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log is the logger of everything not done on behalf of a request. Requests
+// log through the logger in their context, which adds the request id.
+var Log = newLogger(LogFormatText, 0)
+
+// SetupLogging selects the log format. Text logs go through glog, JSON logs
+// are written to stderr one object per line. The glog -v flag sets the
+// verbosity of both.
+func SetupLogging(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	verbosity := 0
+	if v := flag.Lookup("v"); v != nil {
+		verbosity, _ = strconv.Atoi(v.Value.String())
+	}
+	Log = newLogger(format, verbosity)
+	return nil
+}
+
+// logger returns the logger of the request, or Log outside of requests.
+func logger(ctx context.Context) logr.Logger {
+	if l, err := logr.FromContext(ctx); err == nil {
+		return l
+	}
+	return Log
+}
+
+// withRequestID returns a context whose logger tags every line with a new
+// request id and the key value pairs, so that the lines of one RPC can be told
+// apart. The trace id links the lines to the spans when tracing is enabled.
+func withRequestID(ctx context.Context, keysAndValues ...interface{}) (context.Context, logr.Logger) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	values := []interface{}{"requestID", hex.EncodeToString(b)}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		values = append(values, "traceID", sc.TraceID().String())
+	}
+	l := Log.WithValues(append(values, keysAndValues...)...)
+	return logr.NewContext(ctx, l), l
+}
+
+func newLogger(format string, verbosity int) logr.Logger {
+	opts := funcr.Options{Verbosity: verbosity}
+	sink := &logSink{}
+	if format == LogFormatJSON {
+		opts.LogTimestamp = true
+		opts.TimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+		sink.json = true
+		sink.formatter = funcr.NewFormatterJSON(opts)
+	} else {
+		// glog writes the message and the severity itself.
+		opts.RenderBuiltinsHook = func(kvList []interface{}) []interface{} {
+			var kept []interface{}
+			for i := 0; i+1 < len(kvList); i += 2 {
+				if kvList[i] != "level" && kvList[i] != "msg" {
+					kept = append(kept, kvList[i], kvList[i+1])
+				}
+			}
+			return kept
+		}
+		sink.formatter = funcr.NewFormatter(opts)
+	}
+	return logr.New(sink)
+}
+
+// logSink renders log lines with funcr and writes them to glog or stderr.
+type logSink struct {
+	formatter funcr.Formatter
+	json      bool
+}
+
+var stderrMutex sync.Mutex
+
+func (s *logSink) Init(info logr.RuntimeInfo) {
+	s.formatter.Init(info)
+}
+
+func (s *logSink) Enabled(level int) bool {
+	if s.json {
+		return s.formatter.Enabled(level)
+	}
+	return bool(glog.V(glog.Level(level)))
+}
+
+func (s *logSink) Info(level int, msg string, kvList ...interface{}) {
+	prefix, args := s.formatter.FormatInfo(level, msg, kvList)
+	if s.json {
+		s.writeJSON(args)
+		return
+	}
+	glog.InfoDepth(s.formatter.GetDepth()+1, textLine(prefix, msg, args))
+}
+
+func (s *logSink) Error(err error, msg string, kvList ...interface{}) {
+	prefix, args := s.formatter.FormatError(err, msg, kvList)
+	if s.json {
+		s.writeJSON(args)
+		return
+	}
+	glog.ErrorDepth(s.formatter.GetDepth()+1, textLine(prefix, msg, args))
+}
+
+func (s *logSink) writeJSON(obj string) {
+	stderrMutex.Lock()
+	defer stderrMutex.Unlock()
+	fmt.Fprintln(os.Stderr, obj)
+}
+
+func textLine(prefix, msg, args string) string {
+	line := msg
+	if prefix != "" {
+		line = prefix + ": " + line
+	}
+	if args = strings.TrimSpace(args); args != "" {
+		line += " " + args
+	}
+	return line
+}
+
+func (s *logSink) WithValues(kvList ...interface{}) logr.LogSink {
+	c := *s
+	c.formatter.AddValues(kvList)
+	return &c
+}
+
+func (s *logSink) WithName(name string) logr.LogSink {
+	c := *s
+	c.formatter.AddName(name)
+	return &c
+}
+
+func (s *logSink) WithCallDepth(depth int) logr.LogSink {
+	c := *s
+	c.formatter.AddCallDepth(depth)
+	return &c
+}
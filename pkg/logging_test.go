@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr/funcr"
+	"google.golang.org/grpc"
+)
+
+// captureLog replaces Log for the test and returns the lines logged, as JSON.
+func captureLog(t *testing.T) func() []string {
+	t.Helper()
+	var (
+		mutex sync.Mutex
+		lines []string
+	)
+	old := Log
+	Log = funcr.NewJSON(func(obj string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		lines = append(lines, obj)
+	}, funcr.Options{Verbosity: 5})
+	t.Cleanup(func() { Log = old })
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, lines...)
+	}
+}
+
+func TestLogGRPCRequestID(t *testing.T) {
+	lines := captureLog(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		logger(ctx).Info("Formatting device")
+		return nil, errors.New("mkfs failed")
+	}
+	req := &csi.NodeStageVolumeRequest{VolumeId: "pv-1", Secrets: map[string]string{SecretPassphrase: "s3cret"}}
+	LogGRPC(context.Background(), req, info, handler)
+	LogGRPC(context.Background(), req, info, handler)
+
+	requestIDs := map[string]int{}
+	for _, line := range lines() {
+		if strings.Contains(line, "s3cret") {
+			t.Errorf("secret logged: %s", line)
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		id, _ := entry["requestID"].(string)
+		if id == "" || entry["method"] != info.FullMethod {
+			t.Errorf("line without request id and method: %s", line)
+		}
+		requestIDs[id]++
+	}
+	// Call, request, handler, error and response lines of each call.
+	if len(requestIDs) != 2 {
+		t.Errorf("request ids %v, want one per call", requestIDs)
+	}
+	for id, count := range requestIDs {
+		if count != 5 {
+			t.Errorf("request %s logged %d lines, want 5", id, count)
+		}
+	}
+}
+
+func TestSanitized(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{VolumeId: "pv-1", Secrets: map[string]string{SecretPassphrase: "s3cret"}}
+	v, ok := sanitized{req}.MarshalLog().(map[string]interface{})
+	if !ok {
+		t.Fatalf("MarshalLog() = %#v, want a JSON object", sanitized{req}.MarshalLog())
+	}
+	if v["volume_id"] != "pv-1" || v["secrets"] != "***stripped***" {
+		t.Errorf("MarshalLog() = %v, want the volume id and stripped secrets", v)
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	old := Log
+	t.Cleanup(func() { Log = old })
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		if err := SetupLogging(format); err != nil {
+			t.Errorf("SetupLogging(%q): %v", format, err)
+		}
+	}
+	if err := SetupLogging("xml"); err == nil {
+		t.Error("unknown log format accepted")
+	}
+}
+
+func TestTextLine(t *testing.T) {
+	for _, tt := range []struct{ prefix, msg, args, want string }{
+		{msg: "Attaching volume", args: ` "volume"="pv-1"`, want: `Attaching volume "volume"="pv-1"`},
+		{prefix: "gc", msg: "Removing orphaned volume", want: "gc: Removing orphaned volume"},
+	} {
+		if got := textLine(tt.prefix, tt.msg, tt.args); got != tt.want {
+			t.Errorf("textLine(%q, %q, %q) = %q, want %q", tt.prefix, tt.msg, tt.args, got, tt.want)
+		}
+	}
+}
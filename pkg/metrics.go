@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "klc"
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "CSI RPCs by method and status code.",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of CSI RPCs by method.",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method"})
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "command",
+		Name:      "duration_seconds",
+		Help:      "Duration of lvcreate, lvremove, virsh and other commands by operation and result.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"command", "operation", "result"})
+	reconcileIssues = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconcile",
+		Name:      "issues",
+		Help:      "Discrepancies between the attachment records, the domains and the LVs found by the last reconciliation, by kind.",
+	}, []string{"kind"})
+	reconcileRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconcile",
+		Name:      "repairs_total",
+		Help:      "Discrepancies repaired by the reconciler, by kind.",
+	}, []string{"kind"})
+	reconcileRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconcile",
+		Name:      "runs_total",
+		Help:      "Reconciliations by result.",
+	}, []string{"result"})
+	reconcileDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconcile",
+		Name:      "duration_seconds",
+		Help:      "Duration of reconciliations, which hold off controller operations.",
+		Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+	reconcileLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconcile",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time the last successful reconciliation finished.",
+	})
+	gcOrphans = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gc",
+		Name:      "orphaned_volumes",
+		Help:      "Orphaned volumes past the grace period left by the last garbage collection, because they are attached, their removal failed or in dry run mode.",
+	})
+	gcRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gc",
+		Name:      "removed_volumes_total",
+		Help:      "Orphaned volumes removed by the garbage collector.",
+	})
+	gcRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gc",
+		Name:      "runs_total",
+		Help:      "Garbage collections by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcRequests, rpcDuration, commandDuration,
+		reconcileIssues, reconcileRepairs, reconcileRuns, reconcileDuration, reconcileLastSuccess,
+		gcOrphans, gcRemoved, gcRuns)
+}
+
+// MetricsGRPC counts the RPCs and observes their duration.
+func MetricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	rpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// observeCommand records the duration of a command started at start.
+// operation distinguishes the virsh subcommands.
+func observeCommand(command, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	commandDuration.WithLabelValues(command, operation, result).Observe(time.Since(start).Seconds())
+}
+
+// observeReconcile counts a reconciliation started at start and observes its
+// duration.
+func observeReconcile(start time.Time, err error) {
+	reconcileDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		reconcileRuns.WithLabelValues("error").Inc()
+		return
+	}
+	reconcileRuns.WithLabelValues("success").Inc()
+	reconcileLastSuccess.Set(float64(time.Now().Unix()))
+}
+
+// observeGC counts a garbage collection.
+func observeGC(err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	gcRuns.WithLabelValues(result).Inc()
+}
+
+// RegisterControllerMetrics registers the gauges of the volume group, its thin
+// pools and the attachments, collected on every scrape.
+func (driver *Driver) RegisterControllerMetrics() error {
+	return prometheus.Register(&controllerCollector{driver: driver})
+}
+
+var (
+	vgSizeDesc = prometheus.NewDesc(metricsNamespace+"_volume_group_size_bytes",
+		"Size of the volume group.", []string{"volume_group"}, nil)
+	vgFreeDesc = prometheus.NewDesc(metricsNamespace+"_volume_group_free_bytes",
+		"Unallocated space of the volume group.", []string{"volume_group"}, nil)
+	thinDataDesc = prometheus.NewDesc(metricsNamespace+"_thin_pool_data_used_ratio",
+		"Used fraction of the data of a thin pool.", []string{"volume_group", "pool"}, nil)
+	thinMetadataDesc = prometheus.NewDesc(metricsNamespace+"_thin_pool_metadata_used_ratio",
+		"Used fraction of the metadata of a thin pool.", []string{"volume_group", "pool"}, nil)
+	attachmentsDesc = prometheus.NewDesc(metricsNamespace+"_node_attachments",
+		"Volumes attached to a node.", []string{"node"}, nil)
+	scrapeErrorDesc = prometheus.NewDesc(metricsNamespace+"_storage_scrape_error",
+		"1 if querying LVM for the volume group metrics failed.", nil, nil)
+)
+
+type controllerCollector struct {
+	driver *Driver
+}
+
+func (c *controllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vgSizeDesc
+	ch <- vgFreeDesc
+	ch <- thinDataDesc
+	ch <- thinMetadataDesc
+	ch <- attachmentsDesc
+	ch <- scrapeErrorDesc
+}
+
+func (c *controllerCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	vg := c.driver.volumeGroup
+	failed := 0.0
+	size, free, err := c.driver.volumeGroupSpace(ctx)
+	if err != nil {
+		Log.Error(err, "Failed to collect volume group metrics")
+		failed = 1
+	} else {
+		ch <- prometheus.MustNewConstMetric(vgSizeDesc, prometheus.GaugeValue, float64(size), vg)
+		ch <- prometheus.MustNewConstMetric(vgFreeDesc, prometheus.GaugeValue, float64(free), vg)
+	}
+	pools, err := c.driver.thinPools(ctx)
+	if err != nil {
+		Log.Error(err, "Failed to collect thin pool metrics")
+		failed = 1
+	}
+	for _, pool := range pools {
+		ch <- prometheus.MustNewConstMetric(thinDataDesc, prometheus.GaugeValue, pool.DataPercent/100, vg, pool.Name)
+		ch <- prometheus.MustNewConstMetric(thinMetadataDesc, prometheus.GaugeValue, pool.MetadataPercent/100, vg, pool.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, failed)
+
+	attachments := map[string]int{}
+	for _, meta := range ListMetas(ctx) {
+		for nodeId := range meta.Attachments {
+			attachments[nodeId]++
+		}
+	}
+	for nodeId, count := range attachments {
+		ch <- prometheus.MustNewConstMetric(attachmentsDesc, prometheus.GaugeValue, float64(count), nodeId)
+	}
+}
+
+// volumeGroupSpace returns the size and the free bytes of the volume group.
+func (driver *Driver) volumeGroupSpace(ctx context.Context) (int64, int64, error) {
+	out, err := runCommand(ctx, "vgs", "", nil, "--reportformat", "json", "--units", "b", "--nosuffix",
+		"-o", "vg_size,vg_free", driver.volumeGroup)
+	if err != nil {
+		return 0, 0, err
+	}
+	var result struct {
+		Report []struct {
+			VG []struct {
+				Size string `json:"vg_size"`
+				Free string `json:"vg_free"`
+			} `json:"vg"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return 0, 0, fmt.Errorf("parse vgs output: %w", err)
+	}
+	if len(result.Report) == 0 || len(result.Report[0].VG) == 0 {
+		return 0, 0, fmt.Errorf("volume group %s not reported by vgs", driver.volumeGroup)
+	}
+	vg := result.Report[0].VG[0]
+	size, _ := strconv.ParseInt(vg.Size, 10, 64)
+	free, _ := strconv.ParseInt(vg.Free, 10, 64)
+	return size, free, nil
+}
+
+// thinPool is the usage of a thin pool LV in percent.
+type thinPool struct {
+	Name            string
+	DataPercent     float64
+	MetadataPercent float64
+}
+
+// thinPools returns the thin pools of the volume group.
+func (driver *Driver) thinPools(ctx context.Context) ([]thinPool, error) {
+	out, err := runCommand(ctx, "lvs", "", nil, "--reportformat", "json",
+		"-o", "lv_name,lv_attr,data_percent,metadata_percent", driver.volumeGroup)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Report []struct {
+			LV []struct {
+				Name            string `json:"lv_name"`
+				Attr            string `json:"lv_attr"`
+				DataPercent     string `json:"data_percent"`
+				MetadataPercent string `json:"metadata_percent"`
+			} `json:"lv"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("parse lvs output: %w", err)
+	}
+	var pools []thinPool
+	for _, report := range result.Report {
+		for _, lv := range report.LV {
+			// The first attribute of thin pools is t.
+			if len(lv.Attr) == 0 || lv.Attr[0] != 't' {
+				continue
+			}
+			pool := thinPool{Name: lv.Name}
+			pool.DataPercent, _ = strconv.ParseFloat(lv.DataPercent, 64)
+			pool.MetadataPercent, _ = strconv.ParseFloat(lv.MetadataPercent, 64)
+			pools = append(pools, pool)
+		}
+	}
+	return pools, nil
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/TestMetrics"}
+	ok := rpcRequests.WithLabelValues(info.FullMethod, codes.OK.String())
+	notFound := rpcRequests.WithLabelValues(info.FullMethod, codes.NotFound.String())
+	before := testutil.ToFloat64(ok)
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "resp", nil }
+	if resp, err := MetricsGRPC(context.Background(), nil, info, handler); resp != "resp" || err != nil {
+		t.Fatalf("MetricsGRPC() = %v, %v, want the handler result", resp, err)
+	}
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "volume not found")
+	}
+	if _, err := MetricsGRPC(context.Background(), nil, info, failing); status.Code(err) != codes.NotFound {
+		t.Fatalf("MetricsGRPC() error = %v, want the handler error", err)
+	}
+
+	if got := testutil.ToFloat64(ok) - before; got != 1 {
+		t.Errorf("OK requests counted %v times, want 1", got)
+	}
+	if got := testutil.ToFloat64(notFound); got != 1 {
+		t.Errorf("NotFound requests counted %v times, want 1", got)
+	}
+}
+
+func TestControllerCollector(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"vgs": `echo '{"report":[{"vg":[{"vg_size":"107374182400","vg_free":"53687091200"}]}]}'`,
+		"lvs": `echo '{"report":[{"lv":[{"lv_name":"pool","lv_attr":"twi-aotz--","data_percent":"25.00","metadata_percent":"5.00"},{"lv_name":"pv-1","lv_attr":"Vwi-a-tz--","data_percent":"10.00","metadata_percent":""}]}]}'`,
+	})
+	driver := newTestDriver(t)
+	if err := SaveMeta(context.Background(), "pv-1", &VolumeMeta{Attachments: map[string]*Attachment{"vm1": {Name: "vdb"}, "vm2": {Name: "vdb"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(&controllerCollector{driver: driver})
+	want := `
+# HELP klc_node_attachments Volumes attached to a node.
+# TYPE klc_node_attachments gauge
+klc_node_attachments{node="vm1"} 1
+klc_node_attachments{node="vm2"} 1
+# HELP klc_storage_scrape_error 1 if querying LVM for the volume group metrics failed.
+# TYPE klc_storage_scrape_error gauge
+klc_storage_scrape_error 0
+# HELP klc_thin_pool_data_used_ratio Used fraction of the data of a thin pool.
+# TYPE klc_thin_pool_data_used_ratio gauge
+klc_thin_pool_data_used_ratio{pool="pool",volume_group="vg"} 0.25
+# HELP klc_thin_pool_metadata_used_ratio Used fraction of the metadata of a thin pool.
+# TYPE klc_thin_pool_metadata_used_ratio gauge
+klc_thin_pool_metadata_used_ratio{pool="pool",volume_group="vg"} 0.05
+# HELP klc_volume_group_free_bytes Unallocated space of the volume group.
+# TYPE klc_volume_group_free_bytes gauge
+klc_volume_group_free_bytes{volume_group="vg"} 5.36870912e+10
+# HELP klc_volume_group_size_bytes Size of the volume group.
+# TYPE klc_volume_group_size_bytes gauge
+klc_volume_group_size_bytes{volume_group="vg"} 1.073741824e+11
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestControllerCollectorScrapeError(t *testing.T) {
+	fakeCommands(t, map[string]string{"vgs": "exit 5", "lvs": "exit 5"})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(&controllerCollector{driver: newTestDriver(t)})
+	want := `
+# HELP klc_storage_scrape_error 1 if querying LVM for the volume group metrics failed.
+# TYPE klc_storage_scrape_error gauge
+klc_storage_scrape_error 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "klc_storage_scrape_error", "klc_volume_group_size_bytes"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/utils/mount"
+)
+
+// defaultFsType is the filesystem of volumes without a fsType.
+const defaultFsType = "ext4"
+
+// supportedFsTypes are the filesystems volumes can be formatted and mounted with.
+var supportedFsTypes = map[string]bool{
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+// allowedMountFlags are the mount flags a volume capability may ask for.
+var allowedMountFlags = map[string]bool{
+	"defaults":    true,
+	"ro":          true,
+	"rw":          true,
+	"noatime":     true,
+	"nodiratime":  true,
+	"relatime":    true,
+	"strictatime": true,
+	"lazytime":    true,
+	"discard":     true,
+	"nodiscard":   true,
+	"noexec":      true,
+	"nosuid":      true,
+	"nodev":       true,
+	"sync":        true,
+	"dirsync":     true,
+	// xfs
+	"nouuid":  true,
+	"inode64": true,
+	"inode32": true,
+}
+
+// allowedMountFlagPrefixes are the key=value mount flags a volume capability may ask for.
+var allowedMountFlagPrefixes = []string{
+	"commit=",
+	"data=",
+	"errors=",
+	"logbufs=",
+	"logbsize=",
+	"allocsize=",
+}
+
+// validateMount checks the filesystem and mount flags of a mount capability.
+func validateMount(fsType string, flags []string) error {
+	if fsType != "" && !supportedFsTypes[fsType] {
+		return fmt.Errorf("unsupported fsType %q", fsType)
+	}
+	for _, flag := range flags {
+		if !mountFlagAllowed(flag) {
+			return fmt.Errorf("mount flag %q is not allowed", flag)
+		}
+		// Only xfs refuses to mount a second filesystem with the same UUID,
+		// which is the case for clones.
+		if flag == "nouuid" && fsType != "xfs" {
+			return fmt.Errorf("mount flag %q requires fsType xfs", flag)
+		}
+	}
+	return nil
+}
+
+func mountFlagAllowed(flag string) bool {
+	if allowedMountFlags[flag] {
+		return true
+	}
+	for _, prefix := range allowedMountFlagPrefixes {
+		if strings.HasPrefix(flag, prefix) && len(flag) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountFilesystem mounts the fsType filesystem on the device at target.
+func mountFilesystem(ctx context.Context, device, target, fsType string, options []string) error {
+	args := []string{"-t", fsType}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	_, err := runCommand(ctx, "mount", "", nil, append(args, device, target)...)
+	return err
+}
+
+// bindMount bind mounts source at target. Bind mounts ignore ro, a read-only
+// one is remounted and undone if that fails, so that it is never writable.
+func bindMount(ctx context.Context, source, target string, readOnly bool) error {
+	if _, err := runCommand(ctx, "mount", "bind", nil, "--bind", source, target); err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	if err := remountReadOnly(ctx, target); err != nil {
+		if err := unmount(ctx, target); err != nil {
+			logger(ctx).Error(err, "Failed to undo the bind mount", "target", target)
+		}
+		return err
+	}
+	return nil
+}
+
+// unmount unmounts target.
+func unmount(ctx context.Context, target string) error {
+	_, err := runCommand(ctx, "umount", "", nil, target)
+	return err
+}
+
+// remountReadOnly makes the bind mount at target read-only without touching
+// the mount it was bound from.
+func remountReadOnly(ctx context.Context, target string) error {
+	_, err := runCommand(ctx, "mount", "remount", nil, "-o", "remount,bind,ro", target)
+	return err
+}
+
+// makeTarget creates the publish target, a file for block volumes and a
+// directory otherwise.
+func makeTarget(target string, block bool) error {
+	if !block {
+		return os.MkdirAll(target, 0750)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// verifyBindMount checks that target is bind mounted from source, the staging
+// path for filesystem volumes or the device for block volumes.
+func verifyBindMount(source, target string, block bool) error {
+	infos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return err
+	}
+	var sourceInfo, targetInfo *mount.MountInfo
+	for i := range infos {
+		switch infos[i].MountPoint {
+		case filepath.Clean(target):
+			targetInfo = &infos[i]
+		case filepath.Clean(source):
+			sourceInfo = &infos[i]
+		}
+	}
+	if targetInfo == nil {
+		return fmt.Errorf("%s is not mounted", target)
+	}
+
+	if block {
+		device, err := filepath.EvalSymlinks(source)
+		if err != nil {
+			return err
+		}
+		// A bind mounted device node shows up as its path within devtmpfs.
+		if targetInfo.Root != strings.TrimPrefix(device, "/dev") {
+			return fmt.Errorf("%s is mounted from %s, expected %s", target, targetInfo.Root, device)
+		}
+		return nil
+	}
+
+	if sourceInfo == nil {
+		return fmt.Errorf("staging path %s is not mounted", source)
+	}
+	if targetInfo.Major != sourceInfo.Major || targetInfo.Minor != sourceInfo.Minor || targetInfo.Root != sourceInfo.Root {
+		return fmt.Errorf("%s is mounted from %s (%d:%d), expected %s (%d:%d)", target,
+			targetInfo.Source, targetInfo.Major, targetInfo.Minor, sourceInfo.Source, sourceInfo.Major, sourceInfo.Minor)
+	}
+	return nil
+}
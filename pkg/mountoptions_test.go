@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateMount(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsType  string
+		flags   []string
+		wantErr bool
+	}{
+		{name: "default fsType", flags: []string{"noatime", "discard"}},
+		{name: "ext4 options", fsType: "ext4", flags: []string{"data=ordered", "errors=remount-ro", "commit=30"}},
+		{name: "xfs clone", fsType: "xfs", flags: []string{"nouuid", "inode64"}},
+		{name: "unsupported fsType", fsType: "ntfs", wantErr: true},
+		{name: "unknown flag", fsType: "ext4", flags: []string{"suid"}, wantErr: true},
+		{name: "empty value", fsType: "ext4", flags: []string{"data="}, wantErr: true},
+		{name: "option smuggling", fsType: "ext4", flags: []string{"noatime,exec"}, wantErr: true},
+		{name: "nouuid on ext4", fsType: "ext4", flags: []string{"nouuid"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMount(tt.fsType, tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateMount(%q, %q) = %v, want error %v", tt.fsType, tt.flags, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyBindMount(t *testing.T) {
+	setMountInfo(t, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+		"40 22 252:16 / /staging/pv-1 rw,relatime shared:20 - ext4 /dev/vdb rw\n"+
+		"41 22 252:32 / /staging/pv-2 rw,relatime shared:21 - ext4 /dev/vdc rw\n"+
+		"50 22 252:16 / /publish/pv-1 ro,relatime shared:20 - ext4 /dev/vdb rw\n"+
+		"51 22 252:16 /lost+found /publish/subdir ro,relatime shared:20 - ext4 /dev/vdb rw\n")
+
+	tests := []struct {
+		name    string
+		source  string
+		target  string
+		wantErr bool
+	}{
+		{name: "bound from the staging path", source: "/staging/pv-1", target: "/publish/pv-1"},
+		{name: "trailing slash", source: "/staging/pv-1/", target: "/publish/pv-1/"},
+		{name: "other volume", source: "/staging/pv-2", target: "/publish/pv-1", wantErr: true},
+		{name: "subdirectory", source: "/staging/pv-1", target: "/publish/subdir", wantErr: true},
+		{name: "staging path not mounted", source: "/staging/pv-3", target: "/publish/pv-1", wantErr: true},
+		{name: "target not mounted", source: "/staging/pv-1", target: "/publish/pv-3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyBindMount(tt.source, tt.target, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyBindMount(%q, %q) = %v, want error %v", tt.source, tt.target, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMakeTarget(t *testing.T) {
+	dir := t.TempDir()
+	if err := makeTarget(filepath.Join(dir, "pods", "mount"), false); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "pods", "mount")); err != nil || !info.IsDir() {
+		t.Errorf("filesystem target is not a directory: %v", err)
+	}
+	block := filepath.Join(dir, "devices", "pv-1")
+	for i := 0; i < 2; i++ {
+		if err := makeTarget(block, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := os.Stat(block); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("block target is not a file: %v", err)
+	}
+}
+
+func TestBindMountReadOnly(t *testing.T) {
+	calls := fakeCommands(t, map[string]string{
+		"mount":  `case "$1" in -o) exit 32 ;; esac`,
+		"umount": "",
+	})
+	ctx := context.Background()
+	if err := bindMount(ctx, "/staging", "/target", false); err != nil {
+		t.Fatal(err)
+	}
+	// A bind mount that cannot be made read-only is not left writable.
+	if err := bindMount(ctx, "/staging", "/target", true); err == nil {
+		t.Error("bindMount() succeeded without the read-only remount")
+	}
+	want := []string{
+		"mount --bind /staging /target",
+		"mount --bind /staging /target",
+		"mount -o remount,bind,ro /target",
+		"umount /target",
+	}
+	if got := readCalls(t, calls); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
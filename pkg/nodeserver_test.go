@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFilesystemVolumeUsage(t *testing.T) {
+	usage, err := filesystemVolumeUsage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[0].Unit != csi.VolumeUsage_BYTES || usage[1].Unit != csi.VolumeUsage_INODES {
+		t.Fatalf("filesystemVolumeUsage() = %v, want bytes and inodes", usage)
+	}
+	bytes := usage[0]
+	if bytes.Total <= 0 || bytes.Used < 0 || bytes.Available > bytes.Total-bytes.Used {
+		t.Errorf("byte usage %v is inconsistent", bytes)
+	}
+	if _, err := filesystemVolumeUsage(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("filesystemVolumeUsage() of a missing path succeeded")
+	}
+}
+
+func TestBlockVolumeUsage(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "device")
+	if err := ioutil.WriteFile(device, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := blockVolumeUsage(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Total != 4096 || usage[0].Unit != csi.VolumeUsage_BYTES {
+		t.Errorf("blockVolumeUsage() = %v, want a total of 4096 bytes", usage)
+	}
+}
+
+func TestNodeGetVolumeStatsErrors(t *testing.T) {
+	driver := newTestDriver(t)
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		req  *csi.NodeGetVolumeStatsRequest
+		code codes.Code
+	}{
+		{name: "no volume id", req: &csi.NodeGetVolumeStatsRequest{VolumePath: t.TempDir()}, code: codes.InvalidArgument},
+		{name: "no path", req: &csi.NodeGetVolumeStatsRequest{VolumeId: "pv-1"}, code: codes.InvalidArgument},
+		{name: "missing path", req: &csi.NodeGetVolumeStatsRequest{VolumeId: "pv-1", VolumePath: filepath.Join(t.TempDir(), "missing")}, code: codes.NotFound},
+		{name: "not mounted", req: &csi.NodeGetVolumeStatsRequest{VolumeId: "pv-1", VolumePath: t.TempDir()}, code: codes.NotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := driver.NodeGetVolumeStats(ctx, tt.req); status.Code(err) != tt.code {
+				t.Errorf("NodeGetVolumeStats() = %v, want %v", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestStageMountFlags(t *testing.T) {
+	requested := make([]string, 1, 2)
+	requested[0] = "noatime"
+	mnt := &csi.VolumeCapability_MountVolume{MountFlags: requested}
+	if got := stageMountFlags(mnt, true); !reflect.DeepEqual(got, []string{"noatime", "ro"}) {
+		t.Errorf("stageMountFlags() = %q, want noatime,ro", got)
+	}
+	if extended := requested[:2]; extended[1] != "" {
+		t.Errorf("stageMountFlags() wrote %q to the request", extended[1])
+	}
+	if got := stageMountFlags(mnt, false); !reflect.DeepEqual(got, []string{"noatime"}) {
+		t.Errorf("stageMountFlags() = %q, want noatime", got)
+	}
+}
+
+func TestNodeStageReadOnlyDiskIsNotFormatted(t *testing.T) {
+	formatter := newFakeFormatter()
+	driver := &Driver{nodeID: "vm1", formatter: formatter, cryptsetup: newFakeCryptsetup()}
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "pv-1",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		PublishContext:    map[string]string{PublishContextBus: BusVirtio, PublishContextSerial: diskSerial("pv-1"), PublishContextReadOnly: "true"},
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ext4"),
+	}
+	if _, err := driver.NodeStageVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("NodeStageVolume() of a blank read-only disk = %v, want FailedPrecondition", err)
+	}
+	if len(formatter.Args) != 0 {
+		t.Errorf("read-only disk formatted: %v", formatter.Args)
+	}
+}
+
+func TestIsReadOnlyDisk(t *testing.T) {
+	writer := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "")
+	reader := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "")
+	for _, tt := range []struct {
+		publishContext map[string]string
+		capability     *csi.VolumeCapability
+		want           bool
+	}{
+		{publishContext: nil, capability: writer, want: false},
+		{publishContext: map[string]string{PublishContextReadOnly: "false"}, capability: writer, want: false},
+		{publishContext: map[string]string{PublishContextReadOnly: "true"}, capability: writer, want: true},
+		{publishContext: nil, capability: reader, want: true},
+	} {
+		if got := isReadOnlyDisk(tt.publishContext, tt.capability); got != tt.want {
+			t.Errorf("isReadOnlyDisk(%v, %v) = %v, want %v", tt.publishContext, tt.capability.GetAccessMode().GetMode(), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameters understood by CreateVolume.
+const (
+	// ParamPVTags restricts extent allocation to PVs carrying any of the
+	// given LVM tags, e.g. "ssd,rack1" or "@ssd,@rack1".
+	ParamPVTags = "pvTags"
+	// ParamAllocPolicy selects the lvcreate --alloc policy.
+	ParamAllocPolicy = "allocPolicy"
+	// ParamEncrypted enables LUKS encryption of the volume on the node.
+	ParamEncrypted = "encrypted"
+
+	// I/O limits applied by libvirt to the attached disk, see IOTune.
+	ParamTotalBytesSec    = "totalBytesSec"
+	ParamReadBytesSec     = "readBytesSec"
+	ParamWriteBytesSec    = "writeBytesSec"
+	ParamTotalIopsSec     = "totalIopsSec"
+	ParamReadIopsSec      = "readIopsSec"
+	ParamWriteIopsSec     = "writeIopsSec"
+	ParamTotalBytesSecMax = "totalBytesSecMax"
+	ParamReadBytesSecMax  = "readBytesSecMax"
+	ParamWriteBytesSecMax = "writeBytesSecMax"
+	ParamTotalIopsSecMax  = "totalIopsSecMax"
+	ParamReadIopsSecMax   = "readIopsSecMax"
+	ParamWriteIopsSecMax  = "writeIopsSecMax"
+
+	// Disk settings of the attached disk, see DiskOptions.
+	ParamBus          = "bus"
+	ParamCache        = "cache"
+	ParamIO           = "io"
+	ParamDiscard      = "discard"
+	ParamDetectZeroes = "detectZeroes"
+
+	// mkfs options used when the node formats the volume, see MkfsOptions.
+	ParamInodeRatio               = "inodeRatio"
+	ParamReservedBlocksPercentage = "reservedBlocksPercentage"
+	ParamXFSReflink               = "xfsReflink"
+	ParamBlockSize                = "blockSize"
+
+	// Passed by the external-provisioner when --extra-create-metadata is set.
+	ParamPVCName      = "csi.storage.k8s.io/pvc/name"
+	ParamPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	ParamPVName       = "csi.storage.k8s.io/pv/name"
+
+	// SecretPassphrase is the node stage secret key holding the LUKS passphrase.
+	SecretPassphrase = "passphrase"
+)
+
+var allocPolicies = map[string]bool{
+	"contiguous":    true,
+	"cling":         true,
+	"cling_by_tags": true,
+	"normal":        true,
+	"anywhere":      true,
+	"inherit":       true,
+}
+
+// lvmTagPattern matches the characters LVM accepts in a tag, which is at most
+// maxLVMTagLength long. Go regexps cannot count that far.
+var lvmTagPattern = regexp.MustCompile(`^[A-Za-z0-9_+.\-/=!:&#]+$`)
+
+const maxLVMTagLength = 1024
+
+// VolumeParameters are the parsed StorageClass parameters of a volume.
+type VolumeParameters struct {
+	PVTags      []string
+	AllocPolicy string
+	Encrypted   bool
+	IOTune      IOTune
+	Disk        DiskOptions
+	Mkfs        MkfsOptions
+
+	PVName       string
+	PVCName      string
+	PVCNamespace string
+}
+
+// ParseVolumeParameters validates the StorageClass parameters of a CreateVolume request.
+func ParseVolumeParameters(params map[string]string) (*VolumeParameters, error) {
+	vp := &VolumeParameters{}
+
+	if tags, ok := params[ParamPVTags]; ok {
+		for _, tag := range strings.Split(tags, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "@")
+			if tag == "" {
+				continue
+			}
+			if len(tag) > maxLVMTagLength || !lvmTagPattern.MatchString(tag) {
+				return nil, fmt.Errorf("invalid %s: %q is not a valid LVM tag", ParamPVTags, tag)
+			}
+			vp.PVTags = append(vp.PVTags, "@"+tag)
+		}
+	}
+
+	if policy, ok := params[ParamAllocPolicy]; ok {
+		if !allocPolicies[policy] {
+			return nil, fmt.Errorf("invalid %s: %q", ParamAllocPolicy, policy)
+		}
+		vp.AllocPolicy = policy
+	}
+
+	if encrypted, ok := params[ParamEncrypted]; ok {
+		v, err := strconv.ParseBool(encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", ParamEncrypted, encrypted)
+		}
+		vp.Encrypted = v
+	}
+
+	if err := vp.IOTune.parse(params); err != nil {
+		return nil, err
+	}
+	if err := vp.Disk.parse(params); err != nil {
+		return nil, err
+	}
+	if err := vp.Mkfs.parse(params); err != nil {
+		return nil, err
+	}
+
+	vp.PVName = params[ParamPVName]
+	vp.PVCName = params[ParamPVCName]
+	vp.PVCNamespace = params[ParamPVCNamespace]
+
+	return vp, nil
+}
+
+// IOTune holds the libvirt <iotune> limits of a disk. Zero means unlimited.
+// The *Max values are burst limits.
+type IOTune struct {
+	TotalBytesSec    uint64 `xml:"total_bytes_sec,omitempty"`
+	ReadBytesSec     uint64 `xml:"read_bytes_sec,omitempty"`
+	WriteBytesSec    uint64 `xml:"write_bytes_sec,omitempty"`
+	TotalIopsSec     uint64 `xml:"total_iops_sec,omitempty"`
+	ReadIopsSec      uint64 `xml:"read_iops_sec,omitempty"`
+	WriteIopsSec     uint64 `xml:"write_iops_sec,omitempty"`
+	TotalBytesSecMax uint64 `xml:"total_bytes_sec_max,omitempty"`
+	ReadBytesSecMax  uint64 `xml:"read_bytes_sec_max,omitempty"`
+	WriteBytesSecMax uint64 `xml:"write_bytes_sec_max,omitempty"`
+	TotalIopsSecMax  uint64 `xml:"total_iops_sec_max,omitempty"`
+	ReadIopsSecMax   uint64 `xml:"read_iops_sec_max,omitempty"`
+	WriteIopsSecMax  uint64 `xml:"write_iops_sec_max,omitempty"`
+}
+
+type ioTuneField struct {
+	param string
+	// option is the virsh blkdeviotune option.
+	option string
+	value  *uint64
+}
+
+func (t *IOTune) fields() []ioTuneField {
+	return []ioTuneField{
+		{ParamTotalBytesSec, "--total-bytes-sec", &t.TotalBytesSec},
+		{ParamReadBytesSec, "--read-bytes-sec", &t.ReadBytesSec},
+		{ParamWriteBytesSec, "--write-bytes-sec", &t.WriteBytesSec},
+		{ParamTotalIopsSec, "--total-iops-sec", &t.TotalIopsSec},
+		{ParamReadIopsSec, "--read-iops-sec", &t.ReadIopsSec},
+		{ParamWriteIopsSec, "--write-iops-sec", &t.WriteIopsSec},
+		{ParamTotalBytesSecMax, "--total-bytes-sec-max", &t.TotalBytesSecMax},
+		{ParamReadBytesSecMax, "--read-bytes-sec-max", &t.ReadBytesSecMax},
+		{ParamWriteBytesSecMax, "--write-bytes-sec-max", &t.WriteBytesSecMax},
+		{ParamTotalIopsSecMax, "--total-iops-sec-max", &t.TotalIopsSecMax},
+		{ParamReadIopsSecMax, "--read-iops-sec-max", &t.ReadIopsSecMax},
+		{ParamWriteIopsSecMax, "--write-iops-sec-max", &t.WriteIopsSecMax},
+	}
+}
+
+func (t *IOTune) parse(params map[string]string) error {
+	for _, f := range t.fields() {
+		v, ok := params[f.param]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %q", f.param, v)
+		}
+		*f.value = n
+	}
+
+	// Same rules libvirt applies, checked early so CreateVolume fails instead of the attach.
+	if t.TotalBytesSec > 0 && (t.ReadBytesSec > 0 || t.WriteBytesSec > 0) ||
+		t.TotalIopsSec > 0 && (t.ReadIopsSec > 0 || t.WriteIopsSec > 0) ||
+		t.TotalBytesSecMax > 0 && (t.ReadBytesSecMax > 0 || t.WriteBytesSecMax > 0) ||
+		t.TotalIopsSecMax > 0 && (t.ReadIopsSecMax > 0 || t.WriteIopsSecMax > 0) {
+		return errors.New("total I/O limits cannot be combined with read or write limits")
+	}
+	for _, pair := range [][2]uint64{
+		{t.TotalBytesSec, t.TotalBytesSecMax},
+		{t.ReadBytesSec, t.ReadBytesSecMax},
+		{t.WriteBytesSec, t.WriteBytesSecMax},
+		{t.TotalIopsSec, t.TotalIopsSecMax},
+		{t.ReadIopsSec, t.ReadIopsSecMax},
+		{t.WriteIopsSec, t.WriteIopsSecMax},
+	} {
+		if pair[1] > 0 && pair[1] < pair[0] {
+			return errors.New("burst I/O limits must not be lower than the matching limit")
+		}
+		if pair[1] > 0 && pair[0] == 0 {
+			return errors.New("burst I/O limits require the matching limit")
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether no limit is set.
+func (t *IOTune) IsZero() bool {
+	return *t == IOTune{}
+}
+
+// IOTuneOverrides looks up I/O limits replacing the StorageClass limits of a
+// volume, which Kubernetes never changes after provisioning.
+type IOTuneOverrides interface {
+	// IOTuneOverride returns the limits of the PersistentVolume, nil if it
+	// does not override them.
+	IOTuneOverride(ctx context.Context, pvName string) (*IOTune, error)
+}
+
+// ErrInvalidIOTuneOverride is returned for overrides that are no valid limits.
+var ErrInvalidIOTuneOverride = errors.New("invalid I/O limit override")
+
+// parseIOTuneAnnotations returns the limits of the annotations named
+// <prefix><StorageClass parameter>, nil without any.
+func parseIOTuneAnnotations(annotations map[string]string, prefix string) (*IOTune, error) {
+	iotune := &IOTune{}
+	params := map[string]string{}
+	for _, f := range iotune.fields() {
+		if v, ok := annotations[prefix+f.param]; ok {
+			params[f.param] = v
+		}
+	}
+	if len(params) == 0 {
+		return nil, nil
+	}
+	if err := iotune.parse(params); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIOTuneOverride, err)
+	}
+	return iotune, nil
+}
+
+// blkdeviotuneArgs returns the virsh blkdeviotune options setting every limit,
+// including zero ones so that limits removed from a volume are cleared.
+func (t *IOTune) blkdeviotuneArgs() []string {
+	var args []string
+	for _, f := range t.fields() {
+		args = append(args, f.option, strconv.FormatUint(*f.value, 10))
+	}
+	return args
+}
+
+// DiskOptions are the libvirt bus and <driver> settings of an attached disk.
+// An empty bus selects the driver's attach mode, other empty values are
+// left to the libvirt defaults.
+type DiskOptions struct {
+	Bus          string
+	Cache        string
+	IO           string
+	Discard      string
+	DetectZeroes string
+}
+
+var diskOptionValues = map[string][]string{
+	ParamBus:          {BusVirtio, BusSCSI},
+	ParamCache:        {"none", "writeback", "writethrough", "directsync", "unsafe"},
+	ParamIO:           {"native", "threads", "io_uring"},
+	ParamDiscard:      {"unmap", "ignore"},
+	ParamDetectZeroes: {"off", "on", "unmap"},
+}
+
+func (d *DiskOptions) parse(params map[string]string) error {
+	for param, value := range map[string]*string{
+		ParamBus:          &d.Bus,
+		ParamCache:        &d.Cache,
+		ParamIO:           &d.IO,
+		ParamDiscard:      &d.Discard,
+		ParamDetectZeroes: &d.DetectZeroes,
+	} {
+		v, ok := params[param]
+		if !ok {
+			continue
+		}
+		valid := false
+		for _, allowed := range diskOptionValues[param] {
+			valid = valid || v == allowed
+		}
+		if !valid {
+			return fmt.Errorf("invalid %s: %q", param, v)
+		}
+		*value = v
+	}
+
+	// QEMU only supports native AIO on O_DIRECT.
+	if d.IO == "native" && d.Cache != "none" && d.Cache != "directsync" {
+		return fmt.Errorf("%s=native requires %s=none or directsync", ParamIO, ParamCache)
+	}
+	if d.DetectZeroes == "unmap" && d.Discard != "unmap" {
+		return fmt.Errorf("%s=unmap requires %s=unmap", ParamDetectZeroes, ParamDiscard)
+	}
+	return nil
+}
+
+// MkfsOptions tune the filesystem created on a blank volume.
+// Zero values are left to the mkfs defaults.
+type MkfsOptions struct {
+	// InodeRatio is the bytes per inode of ext filesystems.
+	InodeRatio uint64
+	// ReservedBlocksPercentage is the space reserved for root on ext filesystems.
+	ReservedBlocksPercentage *uint64
+	// XFSReflink enables or disables reflink support of xfs.
+	XFSReflink *bool
+	// BlockSize is the filesystem block size in bytes.
+	BlockSize uint64
+}
+
+func (m *MkfsOptions) parse(params map[string]string) error {
+	for param, value := range map[string]*uint64{
+		ParamInodeRatio: &m.InodeRatio,
+		ParamBlockSize:  &m.BlockSize,
+	} {
+		if v, ok := params[param]; ok {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || n == 0 {
+				return fmt.Errorf("invalid %s: %q", param, v)
+			}
+			*value = n
+		}
+	}
+	if v, ok := params[ParamReservedBlocksPercentage]; ok {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n > 50 {
+			return fmt.Errorf("invalid %s: %q", ParamReservedBlocksPercentage, v)
+		}
+		m.ReservedBlocksPercentage = &n
+	}
+	if v, ok := params[ParamXFSReflink]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %q", ParamXFSReflink, v)
+		}
+		m.XFSReflink = &b
+	}
+	if m.BlockSize != 0 && m.BlockSize&(m.BlockSize-1) != 0 {
+		return fmt.Errorf("invalid %s: %d is not a power of two", ParamBlockSize, m.BlockSize)
+	}
+	return nil
+}
+
+// Args returns the mkfs arguments for the filesystem, failing for options the
+// filesystem does not support.
+func (m *MkfsOptions) Args(fsType string) ([]string, error) {
+	var args []string
+	switch fsType {
+	case "ext3", "ext4":
+		if m.XFSReflink != nil {
+			return nil, fmt.Errorf("%s is not supported by %s", ParamXFSReflink, fsType)
+		}
+		if m.InodeRatio != 0 {
+			args = append(args, "-i", strconv.FormatUint(m.InodeRatio, 10))
+		}
+		if m.ReservedBlocksPercentage != nil {
+			args = append(args, "-m", strconv.FormatUint(*m.ReservedBlocksPercentage, 10))
+		}
+		if m.BlockSize != 0 {
+			args = append(args, "-b", strconv.FormatUint(m.BlockSize, 10))
+		}
+	case "xfs":
+		if m.InodeRatio != 0 || m.ReservedBlocksPercentage != nil {
+			return nil, fmt.Errorf("%s and %s are not supported by xfs", ParamInodeRatio, ParamReservedBlocksPercentage)
+		}
+		if m.XFSReflink != nil {
+			reflink := "0"
+			if *m.XFSReflink {
+				reflink = "1"
+			}
+			args = append(args, "-m", "reflink="+reflink)
+		}
+		if m.BlockSize != 0 {
+			args = append(args, "-b", "size="+strconv.FormatUint(m.BlockSize, 10))
+		}
+	case "btrfs":
+		if *m != (MkfsOptions{}) {
+			return nil, fmt.Errorf("mkfs options are not supported by btrfs")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported fsType %q", fsType)
+	}
+	return args, nil
+}
+
+// lvcreateArgs returns the extra lvcreate arguments for the parameters.
+// PV tags are positional and have to come after the volume group.
+func (vp *VolumeParameters) lvcreateArgs() []string {
+	var args []string
+	if vp.AllocPolicy != "" {
+		args = append(args, "--alloc", vp.AllocPolicy)
+	}
+	return append(args, vp.PVTags...)
+}
+
+// VolumeContext returns the parameters handed to the node with the volume.
+// The external-provisioner's csi.storage.k8s.io/ keys are not passed on.
+func VolumeContext(params map[string]string) map[string]string {
+	vc := map[string]string{}
+	for k, v := range params {
+		if !strings.HasPrefix(k, "csi.storage.k8s.io/") {
+			vc[k] = v
+		}
+	}
+	return vc
+}
+
+// isEncrypted reports whether the volume context asks for LUKS encryption.
+func isEncrypted(volumeContext map[string]string) bool {
+	encrypted, _ := strconv.ParseBool(volumeContext[ParamEncrypted])
+	return encrypted
+}
@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVolumeParametersPVTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain", tags: "ssd,rack1", want: []string{"@ssd", "@rack1"}},
+		{name: "prefixed", tags: "@ssd, @rack1", want: []string{"@ssd", "@rack1"}},
+		{name: "empty entries", tags: "ssd,,", want: []string{"@ssd"}},
+		{name: "lvm characters", tags: "a_b+c.d-e/f=g!h:i&j#k", want: []string{"@a_b+c.d-e/f=g!h:i&j#k"}},
+		{name: "longest tag", tags: strings.Repeat("a", maxLVMTagLength), want: []string{"@" + strings.Repeat("a", maxLVMTagLength)}},
+		{name: "too long", tags: strings.Repeat("a", maxLVMTagLength+1), wantErr: true},
+		{name: "space", tags: "ssd disk", wantErr: true},
+		{name: "invalid character", tags: "ssd,rack$1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp, err := ParseVolumeParameters(map[string]string{ParamPVTags: tt.tags})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseVolumeParameters(%q) succeeded, want an error", tt.tags)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeParameters(%q): %v", tt.tags, err)
+			}
+			if !reflect.DeepEqual(vp.PVTags, tt.want) {
+				t.Errorf("PVTags = %q, want %q", vp.PVTags, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVolumeParametersAllocPolicy(t *testing.T) {
+	vp, err := ParseVolumeParameters(map[string]string{ParamAllocPolicy: "cling", ParamPVTags: "ssd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PV tags are positional and have to come last.
+	want := []string{"--alloc", "cling", "@ssd"}
+	if args := vp.lvcreateArgs(); !reflect.DeepEqual(args, want) {
+		t.Errorf("lvcreateArgs() = %q, want %q", args, want)
+	}
+
+	if _, err := ParseVolumeParameters(map[string]string{ParamAllocPolicy: "random"}); err == nil {
+		t.Error("unknown alloc policy accepted")
+	}
+}
+
+func TestParseVolumeParametersIOTune(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    IOTune
+		wantErr bool
+	}{
+		{name: "none", params: map[string]string{}},
+		{name: "total", params: map[string]string{ParamTotalIopsSec: "500", ParamTotalIopsSecMax: "1000"}, want: IOTune{TotalIopsSec: 500, TotalIopsSecMax: 1000}},
+		{name: "read and write", params: map[string]string{ParamReadBytesSec: "1048576", ParamWriteBytesSec: "2097152"}, want: IOTune{ReadBytesSec: 1048576, WriteBytesSec: 2097152}},
+		{name: "not a number", params: map[string]string{ParamTotalBytesSec: "10M"}, wantErr: true},
+		{name: "negative", params: map[string]string{ParamReadIopsSec: "-1"}, wantErr: true},
+		{name: "total and read", params: map[string]string{ParamTotalIopsSec: "500", ParamReadIopsSec: "100"}, wantErr: true},
+		{name: "burst below limit", params: map[string]string{ParamWriteIopsSec: "500", ParamWriteIopsSecMax: "100"}, wantErr: true},
+		{name: "burst without limit", params: map[string]string{ParamReadBytesSecMax: "1048576"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp, err := ParseVolumeParameters(tt.params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseVolumeParameters(%v) succeeded, want an error", tt.params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeParameters(%v): %v", tt.params, err)
+			}
+			if vp.IOTune != tt.want {
+				t.Errorf("IOTune = %+v, want %+v", vp.IOTune, tt.want)
+			}
+			if vp.IOTune.IsZero() != (tt.want == IOTune{}) {
+				t.Errorf("IsZero() = %v", vp.IOTune.IsZero())
+			}
+		})
+	}
+}
+
+func TestBlkdeviotuneArgs(t *testing.T) {
+	iotune := IOTune{TotalIopsSec: 500}
+	args := iotune.blkdeviotuneArgs()
+	// Every limit is passed so that limits removed from the volume are cleared.
+	if len(args) != 2*len(iotune.fields()) {
+		t.Fatalf("blkdeviotuneArgs() = %q, want every limit", args)
+	}
+	for i := 0; i < len(args); i += 2 {
+		want := "0"
+		if args[i] == "--total-iops-sec" {
+			want = "500"
+		}
+		if args[i+1] != want {
+			t.Errorf("%s = %s, want %s", args[i], args[i+1], want)
+		}
+	}
+}
+
+func TestParseVolumeParametersDiskOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    DiskOptions
+		wantErr bool
+	}{
+		{name: "defaults", params: map[string]string{}},
+		{name: "all", params: map[string]string{ParamBus: BusSCSI, ParamCache: "none", ParamIO: "native", ParamDiscard: "unmap", ParamDetectZeroes: "unmap"},
+			want: DiskOptions{Bus: BusSCSI, Cache: "none", IO: "native", Discard: "unmap", DetectZeroes: "unmap"}},
+		{name: "unknown bus", params: map[string]string{ParamBus: "ide"}, wantErr: true},
+		{name: "unknown cache", params: map[string]string{ParamCache: "fast"}, wantErr: true},
+		{name: "native without O_DIRECT", params: map[string]string{ParamIO: "native", ParamCache: "writeback"}, wantErr: true},
+		{name: "native with default cache", params: map[string]string{ParamIO: "native"}, wantErr: true},
+		{name: "detect zeroes unmap without discard", params: map[string]string{ParamDetectZeroes: "unmap"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp, err := ParseVolumeParameters(tt.params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseVolumeParameters(%v) succeeded, want an error", tt.params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeParameters(%v): %v", tt.params, err)
+			}
+			if vp.Disk != tt.want {
+				t.Errorf("Disk = %+v, want %+v", vp.Disk, tt.want)
+			}
+		})
+	}
+}
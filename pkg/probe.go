@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ProbeCheck verifies one dependency of the driver for Probe.
+type ProbeCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ControllerProbeChecks verify the LVM tools, the volume group and libvirt.
+func (driver *Driver) ControllerProbeChecks() []ProbeCheck {
+	checks := commandChecks("lvs", "lvcreate", "lvremove", "vgs", "virsh")
+	return append(checks,
+		ProbeCheck{Name: "volume group", Check: func(ctx context.Context) error {
+			_, err := runCommand(ctx, "vgs", "", nil, driver.volumeGroup)
+			return err
+		}},
+		ProbeCheck{Name: "libvirt", Check: func(ctx context.Context) error {
+			_, err := runCommand(ctx, "virsh", "version", nil, driver.virshArgs("version")...)
+			return err
+		}},
+	)
+}
+
+// NodeProbeChecks verify device access and the mount and mkfs utilities.
+func (driver *Driver) NodeProbeChecks() []ProbeCheck {
+	checks := commandChecks("mount", "umount", "blkid", "mkfs.ext4")
+	return append(checks,
+		ProbeCheck{Name: "devices", Check: func(context.Context) error {
+			_, err := ioutil.ReadDir("/dev")
+			return err
+		}},
+		ProbeCheck{Name: "mounts", Check: func(context.Context) error {
+			_, err := ioutil.ReadFile("/proc/self/mountinfo")
+			return err
+		}},
+	)
+}
+
+func commandChecks(names ...string) []ProbeCheck {
+	var checks []ProbeCheck
+	for _, name := range names {
+		name := name
+		checks = append(checks, ProbeCheck{Name: name, Check: func(context.Context) error {
+			_, err := exec.LookPath(name)
+			return err
+		}})
+	}
+	return checks
+}
+
+// StartProbing runs the checks now and then every interval. Probe reports the
+// driver as not ready until all checks passed, and whenever one fails.
+func (driver *Driver) StartProbing(checks []ProbeCheck, interval time.Duration) {
+	driver.probeMutex.Lock()
+	driver.probing = true
+	driver.probeChecks = checks
+	driver.probeMutex.Unlock()
+
+	go func() {
+		for {
+			driver.runProbeChecks(context.Background(), checks)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// runProbeChecks runs the checks and records the result, unless ctx is done
+// before they finish: checks cut short say nothing about the dependencies.
+func (driver *Driver) runProbeChecks(ctx context.Context, checks []ProbeCheck) {
+	var failed []string
+	for _, check := range checks {
+		if err := check.Check(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", check.Name, err))
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	var err error
+	if len(failed) > 0 {
+		err = fmt.Errorf("probe failed: %s", strings.Join(failed, "; "))
+		logger(ctx).Error(err, "Probe failed")
+	}
+
+	driver.probeMutex.Lock()
+	defer driver.probeMutex.Unlock()
+	driver.probed = true
+	driver.probeErr = err
+}
+
+// probe returns whether the driver is ready. Until the periodic checks
+// finished once, the checks run with ctx, so that they are bounded by the
+// deadline of the Probe RPC. Concurrent Probe RPCs wait for the checks of the
+// first one instead of running them as well.
+func (driver *Driver) probe(ctx context.Context) (bool, error) {
+	driver.probeMutex.Lock()
+	pending := driver.probing && !driver.probed
+	run, running := driver.probeRun, driver.probeRun != nil
+	if pending && !running {
+		run = make(chan struct{})
+		driver.probeRun = run
+	}
+	checks := driver.probeChecks
+	driver.probeMutex.Unlock()
+
+	switch {
+	case !pending:
+	case running:
+		select {
+		case <-run:
+		case <-ctx.Done():
+		}
+	default:
+		driver.runProbeChecks(ctx, checks)
+		driver.probeMutex.Lock()
+		driver.probeRun = nil
+		driver.probeMutex.Unlock()
+		close(run)
+	}
+	return driver.ready()
+}
+
+// ready returns whether the last probe passed, with the failures if it did not.
+// Drivers that do not probe are always ready.
+func (driver *Driver) ready() (bool, error) {
+	driver.probeMutex.RLock()
+	defer driver.probeMutex.RUnlock()
+	if !driver.probing {
+		return true, nil
+	}
+	if !driver.probed {
+		return false, nil
+	}
+	return driver.probeErr == nil, driver.probeErr
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	driver := newTestDriver(t)
+	ctx := context.Background()
+	probe := func() bool {
+		resp, err := driver.Probe(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetReady().GetValue()
+	}
+
+	// Drivers without checks are always ready.
+	if !probe() {
+		t.Error("Probe() not ready without checks")
+	}
+
+	fail := errors.New("volume group vg not found")
+	checkErr := fail
+	checks := []ProbeCheck{
+		{Name: "ok", Check: func(context.Context) error { return nil }},
+		{Name: "volume group", Check: func(context.Context) error { return checkErr }},
+	}
+	driver.probeMutex.Lock()
+	driver.probing = true
+	driver.probeChecks = checks
+	driver.probeMutex.Unlock()
+
+	// Probe runs the checks itself until they ran once.
+	if probe() {
+		t.Error("Probe() ready with a failed check")
+	}
+	if _, err := driver.ready(); err == nil || err.Error() != "probe failed: volume group: "+fail.Error() {
+		t.Errorf("ready() error = %v, want the failed check", err)
+	}
+
+	checkErr = nil
+	if probe() {
+		t.Error("Probe() ran the checks again before the next periodic run")
+	}
+	driver.runProbeChecks(ctx, checks)
+	if !probe() {
+		t.Error("Probe() not ready after the checks passed")
+	}
+}
+
+func TestProbeConcurrent(t *testing.T) {
+	driver := newTestDriver(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	var runs int32
+	checks := []ProbeCheck{{Name: "slow", Check: func(context.Context) error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil
+	}}}
+	driver.probeMutex.Lock()
+	driver.probing = true
+	driver.probeChecks = checks
+	driver.probeMutex.Unlock()
+
+	results := make(chan bool, 2)
+	probe := func() {
+		resp, err := driver.Probe(context.Background(), nil)
+		results <- err == nil && resp.GetReady().GetValue()
+	}
+	go probe()
+	<-started
+	go probe()
+	// Give the second Probe the time to start checks of its own.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if !<-results {
+			t.Error("Probe() not ready after the checks passed")
+		}
+	}
+	if runs != 1 {
+		t.Errorf("checks ran %d times for concurrent Probe RPCs, want once", runs)
+	}
+}
+
+func TestProbeContext(t *testing.T) {
+	driver := newTestDriver(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var checkCtx context.Context
+	checks := []ProbeCheck{{Name: "slow", Check: func(ctx context.Context) error {
+		checkCtx = ctx
+		cancel()
+		return ctx.Err()
+	}}}
+	driver.probeMutex.Lock()
+	driver.probing = true
+	driver.probeChecks = checks
+	driver.probeMutex.Unlock()
+
+	resp, err := driver.Probe(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkCtx != ctx {
+		t.Error("checks did not run with the context of the Probe RPC")
+	}
+	// A check cut short by the RPC deadline is not recorded as a failure.
+	if resp.GetReady().GetValue() || driver.probed || driver.probeErr != nil {
+		t.Errorf("Probe() = %v with probed %v, %v, want not ready and nothing recorded", resp.GetReady().GetValue(), driver.probed, driver.probeErr)
+	}
+}
+
+func TestCommandChecks(t *testing.T) {
+	fakeCommands(t, map[string]string{"lvs": ""})
+	ctx := context.Background()
+	checks := commandChecks("lvs", "klc-missing-command")
+	if err := checks[0].Check(ctx); err != nil {
+		t.Errorf("check of an installed command: %v", err)
+	}
+	if err := checks[1].Check(ctx); err == nil {
+		t.Error("check of a missing command passed")
+	}
+}
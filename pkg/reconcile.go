@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Discrepancies the reconciler reports without repairing them.
+const (
+	// IssueUntrackedDisk is a disk of the volume group attached to a domain
+	// without an attachment record.
+	IssueUntrackedDisk = "untracked_disk"
+	// IssueMissingVolume is an attachment record or an attached disk of a
+	// volume without a LV.
+	IssueMissingVolume = "missing_volume"
+	// IssueMissingDomain is an attachment record of a domain libvirt does
+	// not know.
+	IssueMissingDomain = "missing_domain"
+	// IssueInactiveDomain is an attachment record of a domain that is not
+	// running, whose hot plugged disks are gone.
+	IssueInactiveDomain = "inactive_domain"
+	// IssueOrphanVolume is a LV of the driver missing from the known
+	// volumes, without an attachment record and not attached to a running
+	// domain. The garbage collector removes them when it is enabled.
+	IssueOrphanVolume = "orphan_volume"
+)
+
+// Discrepancies the reconciler repairs.
+const (
+	// RepairStaleAttachment removes the record of a disk missing from the
+	// running domain, e.g. after a crash between detaching and recording it.
+	RepairStaleAttachment = "stale_attachment"
+	// RepairMovedDisk updates the record of a disk attached with another
+	// target name or address than recorded.
+	RepairMovedDisk = "moved_disk"
+)
+
+var reconcileIssueKinds = []string{IssueUntrackedDisk, IssueMissingVolume, IssueMissingDomain, IssueInactiveDomain, IssueOrphanVolume}
+
+// StartReconciling reconciles now and then every interval, or only now when
+// the interval is 0.
+func (driver *Driver) StartReconciling(interval time.Duration, known KnownVolumes) {
+	go func() {
+		for {
+			if err := driver.Reconcile(context.Background(), known); err != nil {
+				Log.Error(err, "Reconciliation failed")
+			}
+			if interval <= 0 {
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Reconcile compares the attachment records with the disks of the domains and
+// the LVs of the volume group. Records of disks that are gone from a running
+// domain are removed and records of moved disks updated, every other
+// discrepancy is logged and counted in the metrics for an operator to look at.
+// Orphaned volumes are only looked for with known volumes, without them every
+// volume that is not published would be one. Controller operations wait while
+// it runs.
+func (driver *Driver) Reconcile(ctx context.Context, known KnownVolumes) (err error) {
+	ctx, span := tracer.Start(ctx, "reconcile")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+	ctx, log := withRequestID(ctx, "operation", "reconcile")
+	start := time.Now()
+	defer func() { observeReconcile(start, err) }()
+
+	if err := driver.lock(ctx); err != nil {
+		return err
+	}
+	defer driver.unlock()
+	log.V(3).Info("Reconciling attachments")
+
+	lvs, err := driver.ListLogicalVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	volumes := map[string]bool{}
+	for _, lv := range lvs {
+		volumes[lv.Name] = true
+	}
+	defined, err := driver.ListDomains(ctx, true)
+	if err != nil {
+		return err
+	}
+	running, err := driver.ListDomains(ctx, false)
+	if err != nil {
+		return err
+	}
+	isDefined := map[string]bool{}
+	for _, nodeId := range defined {
+		isDefined[nodeId] = true
+	}
+	isRunning := map[string]bool{}
+	for _, nodeId := range running {
+		isRunning[nodeId] = true
+	}
+	// disks maps the running domains to the disks of the volume group by
+	// volume id. Domains whose definition cannot be read are left out and
+	// their records kept.
+	disks := map[string]map[string]domainDiskXML{}
+	for _, nodeId := range running {
+		domainDisks, err := driver.domainVolumes(ctx, nodeId)
+		if err != nil {
+			log.Error(err, "Failed to read domain, skipping it", "node", nodeId)
+			continue
+		}
+		disks[nodeId] = domainDisks
+	}
+
+	issues := map[string]int{}
+	report := func(kind string, keysAndValues ...interface{}) {
+		issues[kind]++
+		log.Info("Found discrepancy, not repairing it", append([]interface{}{"issue", kind}, keysAndValues...)...)
+	}
+	repaired := func(kind string, keysAndValues ...interface{}) {
+		reconcileRepairs.WithLabelValues(kind).Inc()
+		log.Info("Repaired discrepancy", append([]interface{}{"repair", kind}, keysAndValues...)...)
+	}
+
+	metas := ListMetas(ctx)
+	for _, volumeId := range sortedKeys(metas) {
+		meta := metas[volumeId]
+		for _, nodeId := range meta.NodeIds() {
+			attachment := meta.Attachments[nodeId]
+			if !volumes[volumeId] {
+				report(IssueMissingVolume, "volume", volumeId, "node", nodeId)
+			}
+			if !isDefined[nodeId] {
+				report(IssueMissingDomain, "volume", volumeId, "node", nodeId)
+				continue
+			}
+			domainDisks, ok := disks[nodeId]
+			if !ok {
+				if !isRunning[nodeId] {
+					report(IssueInactiveDomain, "volume", volumeId, "node", nodeId)
+				}
+				continue
+			}
+			disk, attached := domainDisks[volumeId]
+			if !attached {
+				if err := RemoveAttachment(ctx, volumeId, nodeId); err != nil {
+					return err
+				}
+				repaired(RepairStaleAttachment, "volume", volumeId, "node", nodeId, "target", attachment.Name)
+				continue
+			}
+			if disk.Target.Dev != attachment.Name || !reflect.DeepEqual(disk.driveAddress(), attachment.Address) {
+				old := attachment.Name
+				attachment.Name = disk.Target.Dev
+				attachment.Address = disk.driveAddress()
+				if err := SaveMeta(ctx, volumeId, meta); err != nil {
+					return err
+				}
+				repaired(RepairMovedDisk, "volume", volumeId, "node", nodeId, "target", attachment.Name, "recordedTarget", old)
+			}
+		}
+	}
+
+	if known != nil {
+		if err := driver.findOrphanVolumes(ctx, known, lvs, metas, disks, report); err != nil {
+			log.Error(err, "Failed to list the known volumes, not looking for orphaned volumes")
+		}
+	}
+
+	for _, nodeId := range sortedKeys(disks) {
+		for _, volumeId := range sortedKeys(disks[nodeId]) {
+			if meta, ok := metas[volumeId]; ok && meta.Attachments[nodeId] != nil {
+				continue
+			}
+			target := disks[nodeId][volumeId].Target.Dev
+			report(IssueUntrackedDisk, "volume", volumeId, "node", nodeId, "target", target)
+			if !volumes[volumeId] {
+				report(IssueMissingVolume, "volume", volumeId, "node", nodeId, "target", target)
+			}
+		}
+	}
+
+	for _, kind := range reconcileIssueKinds {
+		reconcileIssues.WithLabelValues(kind).Set(float64(issues[kind]))
+	}
+	log.V(3).Info("Reconciled attachments", "volumes", len(metas), "domains", len(running))
+	return nil
+}
+
+// findOrphanVolumes reports the LVs of the driver missing from the known
+// volumes that have no attachment record and are not attached to a running
+// domain.
+func (driver *Driver) findOrphanVolumes(ctx context.Context, known KnownVolumes, lvs []*LogicalVolume, metas map[string]*VolumeMeta,
+	disks map[string]map[string]domainDiskXML, report func(kind string, keysAndValues ...interface{})) error {
+	ids, err := known.VolumeIDs(ctx)
+	if err != nil {
+		return err
+	}
+	attached := map[string]bool{}
+	for _, domainDisks := range disks {
+		for volumeId := range domainDisks {
+			attached[volumeId] = true
+		}
+	}
+	for _, lv := range lvs {
+		if !driver.OwnsVolume(lv) || ids[lv.Name] || attached[lv.Name] {
+			continue
+		}
+		if _, ok := metas[lv.Name]; ok {
+			continue
+		}
+		created, _ := lv.Tag(TagCreated)
+		report(IssueOrphanVolume, "volume", lv.Name, "created", created, "size", lv.Size)
+	}
+	return nil
+}
+
+// domainVolumes returns the disks of the volume group attached to the domain
+// by volume id.
+func (driver *Driver) domainVolumes(ctx context.Context, nodeId string) (map[string]domainDiskXML, error) {
+	domain, err := driver.DomainXML(ctx, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	disks := map[string]domainDiskXML{}
+	for _, d := range domain.Devices.Disks {
+		if volumeId, ok := driver.volumeOfDevice(d.Source.Dev); ok {
+			disks[volumeId] = d
+		}
+	}
+	return disks, nil
+}
+
+// volumeOfDevice returns the volume id of a device path of the volume group.
+func (driver *Driver) volumeOfDevice(dev string) (string, bool) {
+	prefix := driver.lvPath("")
+	if !strings.HasPrefix(dev, prefix) || len(dev) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(dev, prefix), true
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// reconcileDomainXML is vm1 with a disk moved from vdb to vdc, a disk without
+// a record and a disk whose LV is gone.
+const reconcileDomainXML = `<domain><devices>
+  <disk type="file" device="disk"><source file="/var/lib/libvirt/images/vm1.qcow2"/><target dev="vda" bus="virtio"/></disk>
+  <disk type="block" device="disk"><source dev="/dev/vg/pv-moved"/><target dev="vdc" bus="virtio"/></disk>
+  <disk type="block" device="disk"><source dev="/dev/vg/pv-untracked"/><target dev="vdd" bus="virtio"/></disk>
+  <disk type="block" device="disk"><source dev="/dev/vg/pv-gone"/><target dev="vde" bus="virtio"/></disk>
+</devices></domain>`
+
+// fakeReconcileCommands fakes vm1 running and vm2 defined but shut off, and
+// the LVs of the test volumes.
+func fakeReconcileCommands(t *testing.T) {
+	owned := TagOwner + "test.csi"
+	fakeCommands(t, map[string]string{
+		"virsh": `case "$*" in
+"list --name --all") echo vm1; echo vm2 ;;
+"list --name") echo vm1 ;;
+"dumpxml vm1") echo '` + reconcileDomainXML + `' ;;
+*) exit 1 ;;
+esac`,
+		"lvs": lvsOutput(
+			[2]string{"pv-stale", owned},
+			[2]string{"pv-moved", owned},
+			[2]string{"pv-untracked", owned},
+			[2]string{"pv-inactive", owned},
+			[2]string{"pv-orphan", owned},
+			[2]string{"pv-known", owned},
+			[2]string{"other", ""},
+		),
+	})
+}
+
+func saveTestMetas(t *testing.T, metas map[string]*VolumeMeta) {
+	t.Helper()
+	for volumeId, meta := range metas {
+		if err := SaveMeta(context.Background(), volumeId, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func reconcileIssueCounts() map[string]float64 {
+	counts := map[string]float64{}
+	for _, kind := range reconcileIssueKinds {
+		counts[kind] = testutil.ToFloat64(reconcileIssues.WithLabelValues(kind))
+	}
+	return counts
+}
+
+func reconcileDurationCount(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := reconcileDuration.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestReconcile(t *testing.T) {
+	fakeReconcileCommands(t)
+	driver := newTestDriver(t)
+	ctx := context.Background()
+	saveTestMetas(t, map[string]*VolumeMeta{
+		"pv-stale":    {Attachments: map[string]*Attachment{"vm1": {Name: "vdb"}}},
+		"pv-moved":    {Attachments: map[string]*Attachment{"vm1": {Name: "vdb"}}},
+		"pv-inactive": {Attachments: map[string]*Attachment{"vm2": {Name: "vdb"}}},
+		"pv-lost":     {Attachments: map[string]*Attachment{"vm9": {Name: "vdb"}}},
+	})
+	knownFile := filepath.Join(t.TempDir(), "known")
+	if err := ioutil.WriteFile(knownFile, []byte("pv-known\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := testutil.ToFloat64(reconcileRepairs.WithLabelValues(RepairStaleAttachment))
+	moved := testutil.ToFloat64(reconcileRepairs.WithLabelValues(RepairMovedDisk))
+	runs := reconcileDurationCount(t)
+
+	if err := driver.Reconcile(ctx, NewFileVolumes(knownFile)); err != nil {
+		t.Fatal(err)
+	}
+	if got := reconcileDurationCount(t) - runs; got != 1 {
+		t.Errorf("%d reconciliation durations observed, want 1", got)
+	}
+
+	if _, err := GetMeta(ctx, "pv-stale"); err == nil {
+		t.Error("record of the disk missing from vm1 not removed")
+	}
+	if meta, err := GetMeta(ctx, "pv-moved"); err != nil || meta.Attachments["vm1"].Name != "vdc" {
+		t.Errorf("record of the moved disk = %+v, %v, want target vdc", meta, err)
+	}
+	for _, volumeId := range []string{"pv-inactive", "pv-lost"} {
+		if _, err := GetMeta(ctx, volumeId); err != nil {
+			t.Errorf("record of %s removed: %v", volumeId, err)
+		}
+	}
+	if got := testutil.ToFloat64(reconcileRepairs.WithLabelValues(RepairStaleAttachment)) - stale; got != 1 {
+		t.Errorf("%v stale attachments repaired, want 1", got)
+	}
+	if got := testutil.ToFloat64(reconcileRepairs.WithLabelValues(RepairMovedDisk)) - moved; got != 1 {
+		t.Errorf("%v moved disks repaired, want 1", got)
+	}
+
+	want := map[string]float64{
+		// pv-untracked and pv-gone
+		IssueUntrackedDisk: 2,
+		// pv-lost and pv-gone
+		IssueMissingVolume:  2,
+		IssueMissingDomain:  1,
+		IssueInactiveDomain: 1,
+		// pv-orphan, the other LV is not owned by the driver
+		IssueOrphanVolume: 1,
+	}
+	for kind, n := range reconcileIssueCounts() {
+		if n != want[kind] {
+			t.Errorf("%s issues = %v, want %v", kind, n, want[kind])
+		}
+	}
+}
+
+func TestReconcileOrphanVolumes(t *testing.T) {
+	fakeReconcileCommands(t)
+	driver := newTestDriver(t)
+	ctx := context.Background()
+
+	// Without known volumes every volume that is not published would be
+	// orphaned, none are reported.
+	if err := driver.Reconcile(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := reconcileIssueCounts()[IssueOrphanVolume]; n != 0 {
+		t.Errorf("%v orphaned volumes without known volumes, want 0", n)
+	}
+
+	// Known volumes that cannot be listed only skip the orphaned volumes.
+	if err := driver.Reconcile(ctx, NewFileVolumes(filepath.Join(t.TempDir(), "missing"))); err != nil {
+		t.Fatal(err)
+	}
+	counts := reconcileIssueCounts()
+	if counts[IssueOrphanVolume] != 0 || counts[IssueUntrackedDisk] != 3 {
+		t.Errorf("issues = %v, want untracked disks and no orphaned volumes", counts)
+	}
+}
@@ -4,74 +4,46 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/golang/glog"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
 )
 
+// LogGRPC logs the RPCs. Everything logged on behalf of a request, down to
+// the commands it runs, carries the request id assigned here.
 func LogGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	pri := glog.Level(3)
+	ctx, log := withRequestID(ctx, "method", info.FullMethod)
+
+	level := 3
 	if info.FullMethod == "/csi.v1.Identity/Probe" {
 		// This call occurs frequently, therefore it only gets log at level 5.
-		pri = 5
+		level = 5
 	}
-	glog.V(pri).Infof("GRPC call: %s", info.FullMethod)
+	log.V(level).Info("GRPC call")
+	log.V(5).Info("GRPC request", "request", sanitized{req})
 
-	v5 := glog.V(5)
-	if v5 {
-		v5.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
-	}
 	resp, err := handler(ctx, req)
 	if err != nil {
-		// Always log errors. Probably not useful though without the method name?!
-		glog.Errorf("GRPC error: %v", err)
-	}
-
-	if v5 {
-		v5.Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
-
-		// In JSON format, intentionally logging without stripping secret
-		// fields due to below reasons:
-		// - It's technically complicated because protosanitizer.StripSecrets does
-		//   not construct new objects, it just wraps the existing ones with a custom
-		//   String implementation. Therefore a simple json.Marshal(protosanitizer.StripSecrets(resp))
-		//   will still include secrets because it reads fields directly
-		//   and more complicated code would be needed.
-		// - This is indeed for verification in mock e2e tests. though
-		//   currently no test which look at secrets, but we might.
-		//   so conceptually it seems better to me to include secrets.
-		logGRPCJson(info.FullMethod, req, resp, err)
+		// Always log errors.
+		log.Error(err, "GRPC error")
 	}
+	log.V(5).Info("GRPC response", "response", sanitized{resp})
 
 	return resp, err
 }
 
-// logGRPCJson logs the called GRPC call details in JSON format
-func logGRPCJson(method string, request, reply interface{}, err error) {
-	// Log JSON with the request and response for easier parsing
-	logMessage := struct {
-		Method   string
-		Request  interface{}
-		Response interface{}
-		// Error as string, for backward compatibility.
-		// "" on no error.
-		Error string
-		// Full error dump, to be able to parse out full gRPC error code and message separately in a test.
-		FullError error
-	}{
-		Method:    method,
-		Request:   request,
-		Response:  reply,
-		FullError: err,
-	}
-
-	if err != nil {
-		logMessage.Error = err.Error()
-	}
+// sanitized logs a CSI message with all secret fields stripped. Logging the
+// message directly would include secrets such as LUKS passphrases.
+type sanitized struct {
+	msg interface{}
+}
 
-	msg, err := json.Marshal(logMessage)
-	if err != nil {
-		logMessage.Error = err.Error()
+// MarshalLog renders the stripped message as a JSON value, so that JSON logs
+// nest it instead of quoting it.
+func (s sanitized) MarshalLog() interface{} {
+	stripped := protosanitizer.StripSecrets(s.msg).String()
+	var v interface{}
+	if err := json.Unmarshal([]byte(stripped), &v); err == nil {
+		return v
 	}
-	glog.V(5).Infof("gRPCCall: %s\n", msg)
+	return stripped
 }
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerTLSConfig returns the TLS configuration of a TCP endpoint. Clients
+// must present a certificate signed by clientCAFile when it is set. The files
+// are read again on the next handshake after they changed, so certificates
+// can be rotated without a restart.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config(), nil
+		},
+	}, nil
+}
+
+type tlsReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	mutex    sync.Mutex
+	modTimes []time.Time
+	// failedModTimes are the modification times of files that failed to
+	// load, which are not retried until the files change again.
+	failedModTimes []time.Time
+	current        *tls.Config
+}
+
+// config returns the configuration of the current files, reloading them if
+// they changed. A failed reload keeps the previous configuration.
+func (r *tlsReloader) config() *tls.Config {
+	modTimes := r.stat()
+	r.mutex.Lock()
+	changed := !equalTimes(r.modTimes, modTimes) && !equalTimes(r.failedModTimes, modTimes)
+	r.mutex.Unlock()
+	if changed {
+		if err := r.load(); err != nil {
+			Log.Error(err, "Failed to reload TLS certificates, keeping the previous ones until the files change")
+		} else {
+			Log.Info("Reloaded TLS certificates")
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+func (r *tlsReloader) load() error {
+	modTimes := r.stat()
+	config, err := r.read()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		r.failedModTimes = modTimes
+		return err
+	}
+	r.modTimes = modTimes
+	r.failedModTimes = nil
+	r.current = config
+	return nil
+}
+
+// read builds the configuration from the files. gRPC requires HTTP/2, which
+// is negotiated with ALPN.
+func (r *tlsReloader) read() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair %s, %s: %w", r.certFile, r.keyFile, err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA %s", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// stat returns the modification times of the files, zero for missing ones.
+func (r *tlsReloader) stat() []time.Time {
+	var times []time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		var t time.Time
+		if file != "" {
+			if fi, err := os.Stat(file); err == nil {
+				t = fi.ModTime()
+			}
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for the common name and its
+// key, both with the modification time.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeTestFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName returns the common name of the certificate the config serves.
+func servedName(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "klc", time.Now())
+
+	config, err := ServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served.NextProtos) != 1 || served.NextProtos[0] != "h2" {
+		t.Errorf("NextProtos = %q, want h2 for gRPC", served.NextProtos)
+	}
+	if served.ClientAuth != tls.NoClientCert {
+		t.Errorf("ClientAuth = %v without a client CA", served.ClientAuth)
+	}
+
+	mutual, err := ServerTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served, _ := mutual.GetConfigForClient(&tls.ClientHelloInfo{}); served.ClientAuth != tls.RequireAndVerifyClientCert || served.ClientCAs == nil {
+		t.Errorf("client certificates are not required with a client CA")
+	}
+
+	if _, err := ServerTLSConfig(certFile, filepath.Join(dir, "missing.key"), ""); err == nil {
+		t.Error("ServerTLSConfig() with a missing key succeeded")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, "first", start)
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if name := servedName(t, r.config()); name != "second" {
+		t.Errorf("served %q after rotating the certificate, want second", name)
+	}
+
+	// A broken rotation keeps the previous certificate.
+	broken := start.Add(2 * time.Minute)
+	writeTestFile(t, certFile, []byte("not a certificate"), broken)
+	if name := servedName(t, r.config()); name != "second" {
+		t.Errorf("served %q after a broken rotation, want second", name)
+	}
+
+	// Files that failed to load are not read again until they change, which
+	// the unchanged modification time hides from the reloader here.
+	writeTestCert(t, certFile, keyFile, "third", broken)
+	if err := os.Chtimes(keyFile, start.Add(time.Minute), start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, r.config()); name != "second" {
+		t.Errorf("served %q, want the failed files not to be read again", name)
+	}
+	if err := os.Chtimes(certFile, broken.Add(time.Minute), broken.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, r.config()); name != "third" {
+		t.Errorf("served %q after fixing the rotation, want third", name)
+	}
+
+	// Missing files are retried once they are back.
+	os.Remove(keyFile)
+	if name := servedName(t, r.config()); name != "third" {
+		t.Errorf("served %q with the key missing, want third", name)
+	}
+	if !equalTimes(r.failedModTimes, r.stat()) {
+		t.Errorf("failure with a missing key not recorded")
+	}
+	writeTestCert(t, certFile, keyFile, "fourth", start.Add(10*time.Minute))
+	if name := servedName(t, r.config()); name != "fourth" {
+		t.Errorf("served %q after restoring the key, want fourth", name)
+	}
+}
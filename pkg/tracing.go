@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Trace exporters selected by TracingConfig.Exporter.
+const (
+	TraceExporterOTLP = "otlp"
+	TraceExporterFile = "file"
+)
+
+// TracingConfig configures the export of spans.
+type TracingConfig struct {
+	// Exporter is TraceExporterOTLP or TraceExporterFile.
+	Exporter string
+	// OTLPEndpoint is the host:port of the OTLP gRPC collector. The
+	// OTEL_EXPORTER_OTLP_* environment variables apply when it is empty.
+	OTLPEndpoint string
+	OTLPInsecure bool
+	// File receives the spans as JSON lines for the file exporter.
+	File string
+}
+
+var tracer = otel.Tracer("github.com/tivizi/kvm-lvm-csi")
+
+// SetupTracing installs the global tracer provider of the driver. The returned
+// function flushes the spans not exported yet and must be called on exit.
+func SetupTracing(serviceName, serviceVersion string, config TracingConfig) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		file     io.Closer
+		err      error
+	)
+	switch config.Exporter {
+	case TraceExporterOTLP:
+		var opts []otlptracegrpc.Option
+		if config.OTLPEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.OTLPEndpoint))
+		}
+		if config.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case TraceExporterFile:
+		if config.File == "" {
+			return nil, fmt.Errorf("the %s trace exporter requires a file", TraceExporterFile)
+		}
+		var f *os.File
+		f, err = os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s trace exporter: %w", config.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(serviceVersion),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// TraceGRPC starts the span of an RPC. Backend calls made with the context
+// of the request record child spans.
+func TraceGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := tracer.Start(ctx, info.FullMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemKey.String("grpc")))
+	defer span.End()
+
+	resp, err := handler(ctx, req)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int64(int64(status.Code(err))))
+	endSpan(span, err)
+	return resp, err
+}
+
+// startCommand starts the span of an external command. The returned function
+// ends it and records the duration of the command.
+func startCommand(ctx context.Context, command, operation string) (context.Context, func(error)) {
+	name := command
+	if operation != "" {
+		name += " " + operation
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("command", command),
+		attribute.String("operation", operation),
+	))
+	start := time.Now()
+	return ctx, func(err error) {
+		observeCommand(command, operation, start, err)
+		endSpan(span, err)
+		span.End()
+	}
+}
+
+// startMetadata starts the span of a metadata store call.
+func startMetadata(ctx context.Context, call, volumeId string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "metadata "+call)
+	if volumeId != "" {
+		span.SetAttributes(attribute.String("volume_id", volumeId))
+	}
+	return ctx, func(err error) {
+		endSpan(span, err)
+		span.End()
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     = tracetest.NewSpanRecorder()
+)
+
+// recordSpans installs a tracer provider recording the spans. The global
+// tracer can only be delegated once, so all tests share the recorder.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+func TestTraceGRPC(t *testing.T) {
+	recorder := recordSpans()
+	fakeCommands(t, map[string]string{"lvcreate": "", "lvremove": "exit 5"})
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/TestTrace"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if _, err := runCommand(ctx, "lvcreate", "", nil, "vg"); err != nil {
+			return nil, err
+		}
+		_, err := runCommand(ctx, "lvremove", "", nil, "/dev/vg/pv-1")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if _, err := TraceGRPC(context.Background(), nil, info, handler); status.Code(err) != codes.Internal {
+		t.Fatalf("TraceGRPC() error = %v, want the handler error", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	rpc, ok := spans[info.FullMethod]
+	if !ok {
+		t.Fatalf("no span of the RPC in %v", spans)
+	}
+	if rpc.Status().Code != otelcodes.Error {
+		t.Errorf("RPC span status = %v, want an error", rpc.Status())
+	}
+	for _, name := range []string{"lvcreate", "lvremove"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no span of %s", name)
+			continue
+		}
+		if span.Parent().SpanID() != rpc.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the RPC span", name)
+		}
+	}
+	if spans["lvcreate"].Status().Code == otelcodes.Error || spans["lvremove"].Status().Code != otelcodes.Error {
+		t.Errorf("command span status lvcreate %v, lvremove %v, want only lvremove failed", spans["lvcreate"].Status(), spans["lvremove"].Status())
+	}
+}
+
+func TestSetupTracingFile(t *testing.T) {
+	if _, err := SetupTracing("klc", "1.0.0", TracingConfig{Exporter: TraceExporterFile}); err == nil {
+		t.Error("file exporter without a file accepted")
+	}
+	if _, err := SetupTracing("klc", "1.0.0", TracingConfig{Exporter: "jaeger"}); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+	// The tracer of the package keeps delegating to the first provider
+	// installed, the recorder of the other tests.
+	recordSpans()
+	shutdown, err := SetupTracing("klc", "1.0.0", TracingConfig{Exporter: TraceExporterFile, File: filepath.Join(t.TempDir(), "spans.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}